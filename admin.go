@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PausedKey is set in redis while provisioning is paused, jobs keep queueing up but no VMs are made
+const PausedKey = "provisioning_paused"
+
+func registerAdminRoutes(r gin.IRoutes) {
+	r.GET("/status", getStatus)
+
+	r.GET("/runners", func(c *gin.Context) {
+		runners, err := listRunners()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, runners)
+	})
+
+	r.GET("/runners/:id", func(c *gin.Context) {
+		runner, err := getRunner(c.Param("id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if runner == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+			return
+		}
+		c.JSON(http.StatusOK, runner)
+	})
+
+	r.GET("/vms", func(c *gin.Context) {
+		vms, err := getVMs(c.Request.Context())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		result := make([]VM, 0)
+		for _, v := range vms {
+			if strings.HasPrefix(v.Name, VmNamePrefix) {
+				result = append(result, v)
+			}
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	r.DELETE("/vms/:vmid", forceDeleteVM)
+
+	r.GET("/queues", func(c *gin.Context) {
+		queued, err := listPendingJobs()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deleting, err := listQueuedJobs(DeleteQueueName)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		retrying, err := listRetryingJobs()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{QueueName: queued, DeleteQueueName: deleting, RetryQueueName: retrying})
+	})
+
+	r.POST("/queues/jobs/:runId", func(c *gin.Context) {
+		job, err := requeueRun(c.Param("runId"))
+		if errors.Is(err, ErrJobNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, ErrJobHasRunner) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+	})
+
+	r.DELETE("/queues/jobs/:runId", func(c *gin.Context) {
+		removed, err := removePendingJob(c.Param("runId"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if removed == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "job not queued"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	r.GET("/deadletters", func(c *gin.Context) {
+		jobs, err := listQueuedJobs(DeadLetterQueueName)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, jobs)
+	})
+
+	r.POST("/deadletters/:runId/replay", func(c *gin.Context) {
+		job, err := replayDeadLetter(c.Param("runId"))
+		if errors.Is(err, ErrNotDeadLettered) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+	})
+
+	r.DELETE("/deadletters/:runId", func(c *gin.Context) {
+		removed, err := removeQueuedJob(DeadLetterQueueName, c.Param("runId"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if removed == 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": ErrNotDeadLettered.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	r.GET("/policy", func(c *gin.Context) {
+		rejections, err := getPolicyRejections(c.Request.Context())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"rules": policyRules, "allowForks": PolicyAllowForks, "rejections": rejections})
+	})
+
+	r.GET("/provisioning", func(c *gin.Context) {
+		paused, err := isProvisioningPaused()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"paused": paused})
+	})
+
+	r.POST("/provisioning/pause", func(c *gin.Context) {
+		if err := setProvisioningPaused(true); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"paused": true})
+	})
+
+	r.POST("/provisioning/resume", func(c *gin.Context) {
+		if err := setProvisioningPaused(false); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"paused": false})
+	})
+
+	r.POST("/reconcile", func(c *gin.Context) {
+		result, err := reconcile()
+		if errors.Is(err, ErrReconcileRunning) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
+
+func forceDeleteVM(c *gin.Context) {
+	vmid, err := strconv.Atoi(c.Param("vmid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid vmid"})
+		return
+	}
+
+	//only ever touch our own VMs, this shouldn't be able to take out anything else on the host
+	vms, err := getVMs(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	var found bool
+	for _, v := range vms {
+		if v.Id == vmid && strings.HasPrefix(v.Name, VmNamePrefix) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "vm not found"})
+		return
+	}
+
+	runners, err := listRunners()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, v := range runners {
+		if v.VMID == vmid && v.IsActive() {
+			v.SetError(errors.New("deleted by admin"))
+			v.Deregister(c.Request.Context(), webLogger)
+			v.Save()
+		}
+	}
+
+	webLogger.Info("Force deleting VM", "vmid", vmid)
+	go deleteVM(context.Background(), vmid, webLogger.With("vmid", vmid))
+	c.JSON(http.StatusAccepted, gin.H{"vmid": vmid})
+}
+
+func isProvisioningPaused() (bool, error) {
+	err := rdb.Get(context.Background(), PausedKey).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func setProvisioningPaused(paused bool) error {
+	if paused {
+		return rdb.Set(context.Background(), PausedKey, "1", 0).Err()
+	}
+	return rdb.Del(context.Background(), PausedKey).Err()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"net/http"
+	"strings"
+)
+
+// AdminToken guards everything that isn't the webhook. If it's not set, those endpoints aren't served at all.
+var AdminToken = env.Get("admin.token")
+
+func requireAdmin(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		//EventSource can't set headers, so let the token come in the query too
+		token = c.Query("token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/go-github/v73/github"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type Command struct {
+	Description string
+	Run         func(args []string) error
+}
+
+var commands = map[string]Command{
+	"serve": {
+		Description: "run the webhook receiver and the workers (default)",
+		Run: func(args []string) error {
+			return serve(true)
+		},
+	},
+	"web": {
+		Description: "run the webhook receiver and admin API without workers",
+		Run: func(args []string) error {
+			return serve(false)
+		},
+	},
+	"worker": {
+		Description: "run the workers without the webhook receiver",
+		Run: func(args []string) error {
+			ctx, stop := shutdownContext()
+			defer stop()
+
+			StartWorkers(ctx)
+			<-ctx.Done()
+			StopWorkers()
+			return nil
+		},
+	},
+	"list": {
+		Description: "list our VMs and the runners we know about",
+		Run:         listCommand,
+	},
+	"gc": {
+		Description: "delete orphaned VMs and fail abandoned runners, once",
+		Run:         gcCommand,
+	},
+	"drain": {
+		Description: "pause provisioning and wait for running jobs to finish",
+		Run:         drainCommand,
+	},
+	"deadletters": {
+		Description: "list jobs which ran out of attempts, or replay or drop them",
+		Run:         deadLettersCommand,
+	},
+	"doctor": {
+		Description: "check the configuration and everything we talk to",
+		Run:         doctorCommand,
+	},
+	"simulate": {
+		Description: "send a signed workflow_job webhook to a running scaler",
+		Run:         simulateCommand,
+	},
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, v := range names {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\n", v, commands[v].Description)
+	}
+	_ = w.Flush()
+}
+
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	all := flags.Bool("all", false, "include finished runners")
+	_ = flags.Parse(args)
+
+	vms, err := getVMs(context.Background())
+	if err != nil {
+		return err
+	}
+	runners, err := listRunners()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "VMID\tNAME\tSTATUS")
+	for _, v := range vms {
+		if strings.HasPrefix(v.Name, VmNamePrefix) {
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\n", v.Id, v.Name, v.Status)
+		}
+	}
+	_, _ = fmt.Fprintln(w)
+
+	_, _ = fmt.Fprintln(w, "RUNNER\tSTATE\tVMID\tNODE\tIP\tREPO\tUPDATED\tERROR")
+	for _, v := range runners {
+		if !*all && !v.IsActive() {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", v.Id, v.State, v.VMID, v.Node, v.IP, v.Repo, v.Updated.Format(time.DateTime), v.Error)
+	}
+	return w.Flush()
+}
+
+func gcCommand(args []string) error {
+	result, err := reconcile()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted VMs: %v\nFailed runners: %v\nIdle runners: %v\nPruned runners: %d\nActive runners: %d\n",
+		result.DeletedVMs, result.FailedRunners, result.IdleRunners, len(result.PrunedRunners), result.ActiveRunners)
+	return nil
+}
+
+func drainCommand(args []string) error {
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 0, "give up waiting after this long, 0 waits forever")
+	resume := flags.Bool("resume", false, "resume provisioning instead of draining")
+	_ = flags.Parse(args)
+
+	if *resume {
+		if err := setProvisioningPaused(false); err != nil {
+			return err
+		}
+		fmt.Println("Provisioning resumed")
+		return nil
+	}
+
+	if err := setProvisioningPaused(true); err != nil {
+		return err
+	}
+	fmt.Println("Provisioning paused, waiting for runners to finish")
+
+	deadline := time.Now().Add(*timeout)
+	for {
+		runners, err := listRunners()
+		if err != nil {
+			return err
+		}
+		var active int
+		for _, v := range runners {
+			if v.IsActive() && !v.IsAbandoned() {
+				active++
+			}
+		}
+		if active == 0 {
+			fmt.Println("Drained")
+			return nil
+		}
+		if *timeout > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("timed out with %d runners still active", active)
+		}
+
+		fmt.Printf("%d runners still active\n", active)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func deadLettersCommand(args []string) error {
+	flags := flag.NewFlagSet("deadletters", flag.ExitOnError)
+	replay := flags.String("replay", "", "put the job for this run id back on the queue")
+	drop := flags.String("drop", "", "forget the job for this run id")
+	_ = flags.Parse(args)
+
+	if *replay != "" {
+		job, err := replayDeadLetter(*replay)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Requeued run %s\n", job.RunId)
+		return nil
+	}
+
+	if *drop != "" {
+		removed, err := removeQueuedJob(DeadLetterQueueName, *drop)
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return ErrNotDeadLettered
+		}
+		fmt.Printf("Dropped run %s\n", *drop)
+		return nil
+	}
+
+	jobs, err := listQueuedJobs(DeadLetterQueueName)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "RUN\tJOB\tREPO\tATTEMPTS\tFAILED\tERROR")
+	for _, v := range jobs {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", v.RunId, v.JobName, v.Repo, v.Attempt, v.DeadLettered.Format(time.DateTime), v.LastError)
+	}
+	return w.Flush()
+}
+
+type doctorCheck struct {
+	Name  string
+	Check func() (string, error)
+}
+
+func doctorCommand(args []string) error {
+	checks := []doctorCheck{
+		{"Redis", func() (string, error) {
+			return rdb.Options().Addr, rdb.Ping(context.Background()).Err()
+		}},
+		{"GitHub token", checkGithubToken},
+		{"Webhook", func() (string, error) {
+			if len(GithubSecrets) == 0 {
+				return "", ErrNoWebhookSecret
+			}
+			networks, err := loadWebhookAllow()
+			return fmt.Sprintf("%d secrets, %d allowed ranges", len(GithubSecrets), len(networks)), err
+		}},
+		{"Runner group", func() (string, error) {
+			scope, target := defaultScope()
+			if scope == ScopeRepo {
+				return "not used for repo runners", nil
+			}
+			//only looked for, doctor shouldn't go creating anything
+			org := orgFor(scope, target)
+			id, err := findRunnerGroup(context.Background(), org.Client, scope, target, org.Group)
+			if errors.Is(err, ErrRunnerGroupNotFound) && GithubGroupCreate {
+				return fmt.Sprintf("%s in %s %s doesn't exist, it will be created", org.Group, scope, target), nil
+			}
+			return fmt.Sprintf("%s in %s %s (%d)", org.Group, scope, target, id), err
+		}},
+		{"Proxmox", func() (string, error) {
+			vms, err := getVMs(context.Background())
+			return fmt.Sprintf("%d VMs on %s", len(vms), ProxmoxNode), err
+		}},
+		{"Template", func() (string, error) {
+			config, err := getVMConfig(context.Background(), TemplateVmId)
+			if err != nil {
+				return "", err
+			}
+			if config.Template != 1 {
+				return config.Name, fmt.Errorf("VM %d is not a template", TemplateVmId)
+			}
+			return fmt.Sprintf("%s (%d)", config.Name, TemplateVmId), nil
+		}},
+		{"Cloud-init", checkCloudInit},
+		{"Log directory", func() (string, error) {
+			file, err := os.CreateTemp(logDir, ".doctor-*")
+			if err != nil {
+				return logDir, err
+			}
+			Close(file)
+			return logDir, os.Remove(file.Name())
+		}},
+	}
+
+	var failed int
+	for _, v := range checks {
+		detail, err := v.Check()
+		if err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n", v.Name, strings.TrimSpace(detail+" "+err.Error()))
+		} else {
+			fmt.Printf("[ OK ] %s: %s\n", v.Name, detail)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// checkGithubToken makes sure the token works, and if it's a classic token, that it can manage org runners
+func checkGithubToken() (string, error) {
+	user, response, err := githubClient.Users.Get(context.Background(), "")
+	defer CloseGithubResponse(response)
+	if err != nil {
+		return "", err
+	}
+
+	//fine-grained tokens and apps don't report scopes, the runner group check covers those
+	scopes := response.Header.Get("X-OAuth-Scopes")
+	if scopes == "" {
+		return user.GetLogin() + " (no scopes reported)", nil
+	}
+	for _, v := range strings.Split(scopes, ",") {
+		if v = strings.TrimSpace(v); v == "admin:org" || v == "manage_runners:org" {
+			return fmt.Sprintf("%s (%s)", user.GetLogin(), scopes), nil
+		}
+	}
+	return user.GetLogin(), fmt.Errorf("token needs admin:org or manage_runners:org, has %s", scopes)
+}
+
+// checkCloudInit makes sure the template has a cloud-init drive, without one our VMs never get their SSH key
+func checkCloudInit() (string, error) {
+	if CloudInitUser == "" {
+		return "", errors.New("cloudinit.ssh.user is not set")
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/config", ProxmoxUrl, ProxmoxNode, TemplateVmId))
+	if err != nil {
+		return "", err
+	}
+	config, err := doRequest[map[string]any](context.Background(), http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for k, v := range config {
+		if value, ok := v.(string); ok && strings.Contains(value, "cloudinit") {
+			return fmt.Sprintf("%s drive, user %s", k, CloudInitUser), nil
+		}
+	}
+	return "", fmt.Errorf("template %d has no cloud-init drive to pass the SSH key through", TemplateVmId)
+}
+
+func simulateCommand(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	target := flags.String("url", "http://localhost:8080/queue", "webhook endpoint of the scaler")
+	action := flags.String("action", "queued", "workflow_job action to send")
+	runId := flags.Int64("run", time.Now().Unix(), "run id for the fake job")
+	label := flags.String("label", "", "runner label on the fake job, default the org's label")
+	repo := flags.String("repo", "", "owner/name of the repo the fake job is from")
+	org := flags.String("org", "", "org the fake job is from")
+	_ = flags.Parse(args)
+
+	if *repo == "" && *org == "" {
+		return errors.New("simulate needs -repo or -org")
+	}
+	if *label == "" {
+		*label = getOrg(*org).Label
+	}
+
+	event := &github.WorkflowJobEvent{
+		Action: github.Ptr(*action),
+		WorkflowJob: &github.WorkflowJob{
+			ID:     github.Ptr(*runId),
+			RunID:  github.Ptr(*runId),
+			Name:   github.Ptr("simulated"),
+			Labels: []string{*label},
+		},
+	}
+	if *org != "" {
+		event.Org = &github.Organization{Login: github.Ptr(*org)}
+	}
+	if *repo != "" {
+		owner, name, found := strings.Cut(*repo, "/")
+		if !found || owner == "" || name == "" {
+			return fmt.Errorf("repo %s should be owner/name", *repo)
+		}
+		event.Repo = &github.Repository{
+			FullName: github.Ptr(*repo),
+			Name:     github.Ptr(name),
+			Owner:    &github.User{Login: github.Ptr(owner)},
+		}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if len(GithubSecrets) == 0 {
+		return ErrNoWebhookSecret
+	}
+	mac := hmac.New(sha256.New, GithubSecrets[0])
+	mac.Write(payload)
+
+	delivery := make([]byte, 16)
+	_, _ = rand.Read(delivery)
+
+	request, err := http.NewRequest(http.MethodPost, *target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-GitHub-Event", "workflow_job")
+	request.Header.Set("X-GitHub-Delivery", hex.EncodeToString(delivery))
+	request.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	response, err := httpClient.Do(request)
+	defer CloseResponse(response)
+	if err != nil {
+		return err
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	fmt.Printf("%s %d %s\n", *target, response.StatusCode, string(body))
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook rejected with %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// how many runners the dashboard gets sent, older ones are still in the admin API
+const statusRunnerLimit = 50
+const statusFailureLimit = 20
+
+type Status struct {
+	Paused      bool                      `json:"paused"`
+	QueueDepth  int64                     `json:"queueDepth"`
+	Retrying    int64                     `json:"retrying"`
+	DeadLetters int64                     `json:"deadLetters"`
+	Rejected    map[string]int64          `json:"rejected"`
+	RateLimits  []RateLimit               `json:"rateLimits"`
+	States      map[string]int            `json:"states"`
+	Nodes       map[string]map[string]int `json:"nodes"`
+	Runners     []*Runner                 `json:"runners"`
+	Failures    []*Runner                 `json:"failures"`
+	Updated     time.Time                 `json:"updated"`
+}
+
+// registerDashboard serves the UI itself. It has no secrets in it, the data comes from the admin API.
+func registerDashboard(r gin.IRoutes) {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	r.StaticFS("/dashboard", http.FS(files))
+}
+
+func getStatus(c *gin.Context) {
+	status := &Status{
+		States:  make(map[string]int),
+		Nodes:   make(map[string]map[string]int),
+		Updated: time.Now(),
+	}
+
+	var err error
+	status.Paused, err = isProvisioningPaused()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status.QueueDepth, err = countPendingJobs()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status.Retrying, err = rdb.ZCard(context.Background(), RetryQueueName).Result()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status.DeadLetters, err = rdb.LLen(context.Background(), DeadLetterQueueName).Result()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status.Rejected, err = getPolicyRejections(context.Background())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	limits, err := getRateLimits(context.Background())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status.RateLimits = latestRateLimits(limits)
+
+	runners, err := listRunners()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, v := range runners {
+		if v.IsActive() {
+			status.States[v.State]++
+			if status.Nodes[v.Node] == nil {
+				status.Nodes[v.Node] = make(map[string]int)
+			}
+			status.Nodes[v.Node][v.State]++
+		}
+		if v.State == StateFailed && len(status.Failures) < statusFailureLimit {
+			status.Failures = append(status.Failures, v)
+		}
+	}
+
+	status.Runners = runners
+	if len(status.Runners) > statusRunnerLimit {
+		status.Runners = status.Runners[:statusRunnerLimit]
+	}
+
+	c.JSON(http.StatusOK, status)
+}
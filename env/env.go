@@ -4,12 +4,15 @@ import (
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
 )
 
+// cache is read from whatever goroutine wants config, so it's only touched under cacheLock
 var cache = make(map[string]string)
+var cacheLock sync.RWMutex
 
 func init() {
 	viper.AutomaticEnv()
@@ -17,7 +20,9 @@ func init() {
 }
 
 func Get(key string) string {
+	cacheLock.RLock()
 	val, exists := cache[key]
+	cacheLock.RUnlock()
 	if exists {
 		return val
 	}
@@ -28,14 +33,18 @@ func Get(key string) string {
 	}
 	val, err := readSecret(filename)
 	if err != nil {
-		log.Printf("error reading secret: %s", err.Error())
+		slog.Error("Failed to read secret", "key", key, "file", filename, "error", err)
 	}
 	//update cache with the full value, so we don't constantly read it
+	cacheLock.Lock()
 	cache[key] = val
+	cacheLock.Unlock()
 	return val
 }
 
 func Set(key string, val string) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	cache[key] = val
 }
 
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-github/v73/github"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"strconv"
+	"time"
+)
+
+// RunnerAssignmentsKey holds the job each runner picked up, by runner id. It's kept apart from the runner
+// as it's written by whoever got the webhook, while the runner itself is saved by the worker driving it.
+const RunnerAssignmentsKey = "runner_assignments"
+
+// WaitingJobsKey holds jobs waiting on an approval or a protection rule before they're queued, by job id
+const WaitingJobsKey = "workflow_waiting"
+
+// WebhookEventsKey counts the webhooks we've had, by event and action
+const WebhookEventsKey = "webhook_events"
+
+// InstallationsKey is where each account has the app installed, suspended or removed, by account
+const InstallationsKey = "github_installations"
+
+// RunnerIdleTimeout is how long, in seconds, a runner can go without picking up a job before its VM is
+// deleted. It relies on workflow_job in_progress webhooks to know what's been picked up, 0 leaves them be.
+var RunnerIdleTimeout = time.Duration(env.GetInt("runner.idle.timeout")) * time.Second
+
+// RunnerCompletedTimeout is how long a runner can still be going after its job completed before its VM is deleted
+var RunnerCompletedTimeout = time.Duration(env.GetIntOr("runner.completed.timeout", 600)) * time.Second
+
+// RunnerOrphanTimeout is how long a runner can keep running its job after whoever started it has gone away,
+// before its VM is deleted anyway. The default is GitHub's own limit for a job.
+var RunnerOrphanTimeout = time.Duration(env.GetIntOr("runner.orphan.timeout", 21600)) * time.Second
+
+// Assignment is the job a runner actually picked up. Any of our runners can take any job with the label,
+// so it isn't necessarily the job the runner was made for.
+type Assignment struct {
+	JobId      int64     `json:"jobId"`
+	RunId      string    `json:"runId"`
+	JobName    string    `json:"jobName,omitempty"`
+	Repo       string    `json:"repo,omitempty"`
+	Assigned   time.Time `json:"assigned"`
+	Completed  time.Time `json:"completed,omitempty"`
+	Conclusion string    `json:"conclusion,omitempty"`
+}
+
+func countWebhookEvent(ctx context.Context, event string, action string) {
+	field := event
+	if action != "" {
+		field += ":" + action
+	}
+	rdb.HIncrBy(ctx, WebhookEventsKey, field, 1)
+}
+
+// onJobInProgress ties the job to the runner, and so the VM, which picked it up. If that isn't the job the runner
+// was made for, the job it did pick up hasn't been through the policy with this runner in mind, so it's checked now.
+func onJobInProgress(ctx context.Context, job QueuedJob, event *github.WorkflowJobEvent) {
+	//it's not waiting on anything anymore
+	rdb.HDel(ctx, WaitingJobsKey, jobField(job.JobId))
+
+	runner, err := findRunnerByGithubName(job.RunnerName)
+	if err != nil {
+		webLogger.Error("Failed to look up runner", append(job.logAttrs(), "github_runner", job.RunnerName, "error", err)...)
+		return
+	}
+	if runner == nil {
+		//someone else's runner, or one from before we kept track
+		return
+	}
+
+	assignment := &Assignment{
+		JobId:    job.JobId,
+		RunId:    job.RunId,
+		JobName:  job.JobName,
+		Repo:     job.Repo,
+		Assigned: time.Now(),
+	}
+	if err = saveAssignment(ctx, runner.Id, assignment); err != nil {
+		webLogger.Error("Failed to save runner assignment", append(job.logAttrs(), "runner", runner.Id, "error", err)...)
+		return
+	}
+	webLogger.Info("Runner picked up job", append(job.logAttrs(), "runner", runner.Id, "vmid", runner.VMID, "github_runner", job.RunnerName)...)
+
+	if runner.JobId != job.JobId {
+		//looking the run up and deleting the VM both take a while, GitHub won't wait that long for the webhook
+		go enforceAssignmentPolicy(runner, job, event)
+	}
+}
+
+// enforceAssignmentPolicy deletes the runner's VM if the job it picked up isn't allowed a runner, or there's no
+// telling if it is. The job it was made for is still waiting on GitHub, so that's queued again.
+func enforceAssignmentPolicy(runner *Runner, job QueuedJob, event *github.WorkflowJobEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	logger := webLogger.With(append(job.logAttrs(), "runner", runner.Id, "vmid", runner.VMID)...)
+
+	rejection := checkPolicy(event)
+	var err error
+	if rejection == nil {
+		rejection, err = checkRunPolicy(ctx, job)
+	}
+	switch {
+	case err != nil:
+		logger.Error("Failed to check policy for the job the runner picked up, deleting it", "error", err)
+	case rejection != nil:
+		logger.Warn("Runner picked up a job rejected by policy, deleting it", "rule", rejection.Rule, "value", rejection.Value)
+		countPolicyRejection(ctx, rejection)
+	default:
+		return
+	}
+
+	deleteVM(ctx, runner.VMID, logger)
+	if runner.RunId == "" || runner.JobId == 0 {
+		return
+	}
+	if err = enqueueJob(ctx, runner.job()); err != nil {
+		logger.Error("Failed to requeue the job the runner was made for", "error", err)
+	}
+}
+
+// onJobCompleted records how the job went on the runner that ran it. Jobs which finished without ever
+// getting one of our runners, i.e. cancelled while queued, don't need one anymore, so they're dropped.
+func onJobCompleted(ctx context.Context, job QueuedJob) {
+	rdb.HDel(ctx, WaitingJobsKey, jobField(job.JobId))
+
+	runner, err := findRunnerByGithubName(job.RunnerName)
+	if err != nil {
+		workerLogger.Error("Failed to look up runner", append(job.logAttrs(), "github_runner", job.RunnerName, "error", err)...)
+		return
+	}
+	if runner != nil {
+		assignment := runner.Assignment
+		if assignment == nil || assignment.JobId != job.JobId {
+			//missed the in_progress webhook
+			assignment = &Assignment{JobId: job.JobId, RunId: job.RunId, JobName: job.JobName, Repo: job.Repo, Assigned: time.Now()}
+		}
+		assignment.Completed = time.Now()
+		assignment.Conclusion = job.Conclusion
+		if err = saveAssignment(ctx, runner.Id, assignment); err != nil {
+			workerLogger.Error("Failed to save runner assignment", append(job.logAttrs(), "runner", runner.Id, "error", err)...)
+		}
+		return
+	}
+
+	if job.JobId == 0 {
+		return
+	}
+	removed, err := removeJobId(ctx, job.JobId)
+	if err != nil {
+		workerLogger.Error("Failed to drop finished job from the queue", append(job.logAttrs(), "error", err)...)
+		return
+	}
+	if removed {
+		workerLogger.Info("Dropped job which finished before it got a runner", append(job.logAttrs(), "conclusion", job.Conclusion)...)
+	}
+}
+
+// onJobWaiting keeps track of jobs held up on an approval, so they can be seen before they're queued
+func onJobWaiting(ctx context.Context, job QueuedJob) {
+	if err := rdb.HSet(ctx, WaitingJobsKey, jobField(job.JobId), job.encode()).Err(); err != nil {
+		webLogger.Error("Failed to save waiting job", append(job.logAttrs(), "error", err)...)
+	}
+}
+
+func onPing(event *github.PingEvent) {
+	webLogger.Info("Webhook ping", "hook", event.GetHookID(), "zen", event.GetZen())
+}
+
+// onInstallation keeps track of where the app can register runners. Jobs from an account it's been
+// suspended or removed from are still queued, but there's a warning to go with the failures.
+func onInstallation(ctx context.Context, event *github.InstallationEvent) {
+	account := event.GetInstallation().GetAccount().GetLogin()
+	if account == "" {
+		return
+	}
+	state := event.GetAction()
+	if err := rdb.HSet(ctx, InstallationsKey, account, state).Err(); err != nil {
+		webLogger.Error("Failed to save installation", "account", account, "error", err)
+	}
+	switch state {
+	case "deleted", "suspend":
+		webLogger.Warn("App can no longer register runners", "account", account, "action", state)
+	default:
+		webLogger.Info("App installation changed", "account", account, "action", state)
+	}
+}
+
+func jobField(jobId int64) string {
+	return strconv.FormatInt(jobId, 10)
+}
+
+func saveAssignment(ctx context.Context, runnerId string, assignment *Assignment) error {
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, RunnerAssignmentsKey, runnerId, data).Err()
+}
+
+// loadAssignments fills in what each runner picked up
+func loadAssignments(ctx context.Context, runners ...*Runner) error {
+	if len(runners) == 0 {
+		return nil
+	}
+	ids := make([]string, len(runners))
+	for i, v := range runners {
+		ids[i] = v.Id
+	}
+	values, err := rdb.HMGet(ctx, RunnerAssignmentsKey, ids...).Result()
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		assignment := &Assignment{}
+		if json.Unmarshal([]byte(data), assignment) == nil {
+			runners[i].Assignment = assignment
+		}
+	}
+	return nil
+}
+
+func findRunnerByGithubName(name string) (*Runner, error) {
+	if name == "" {
+		return nil, nil
+	}
+	runners, err := listRunners()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range runners {
+		if v.GithubName == name {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// IsIdle is if the runner has been waiting on a job for longer than it's allowed to
+func (r *Runner) IsIdle() bool {
+	return RunnerIdleTimeout > 0 && r.State == StateRunning && r.Assignment == nil &&
+		!r.Started.IsZero() && time.Since(r.Started) > RunnerIdleTimeout
+}
+
+// IsRunningJob is if the runner is partway through its job, and hasn't been at it for longer than any job should take
+func (r *Runner) IsRunningJob() bool {
+	return r.State == StateRunning && r.Assignment != nil && r.Assignment.Completed.IsZero() &&
+		time.Since(r.Assignment.Assigned) < RunnerOrphanTimeout
+}
+
+// IsStuck is if the runner's job completed a while ago, but the runner never went away
+func (r *Runner) IsStuck() bool {
+	return RunnerCompletedTimeout > 0 && r.IsActive() && r.Assignment != nil &&
+		!r.Assignment.Completed.IsZero() && time.Since(r.Assignment.Completed) > RunnerCompletedTimeout
+}
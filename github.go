@@ -2,52 +2,145 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"github.com/bartventer/httpcache"
 	_ "github.com/bartventer/httpcache/store/memcache" //  Register the in-memory backend
 	"github.com/google/go-github/v73/github"
 	"github.com/pufferpanel/github-runner-scaler/env"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
-var githubClient = github.NewClient(httpcache.NewClient("memcache://")).WithAuthToken(env.Get("github.token"))
+var githubClient, githubRateLimiter = newGithubClient(env.GetOr("github.organization", "default"), env.Get("github.token"))
 var githubOrganization = env.Get("github.organization")
 var githubLabel = env.Get("github.label")
 var githubGroup = env.Get("github.group")
 var githubRunnerPrefix = env.Get("github.runnerprefix")
+var githubEnterprise = env.Get("github.enterprise")
 
-func GetJITConfig(id int) (string, error) {
-	groupId, err := GetRunnerGroupId()
+var githubLogger = newLogger("github")
+
+// githubScope is where runners are registered: org, repo, enterprise, or auto to go off the webhook
+var githubScope = env.GetOr("github.scope", ScopeAuto)
+
+const (
+	ScopeAuto       = "auto"
+	ScopeOrg        = "org"
+	ScopeRepo       = "repo"
+	ScopeEnterprise = "enterprise"
+)
+
+// repos have no runner groups, but registering still wants one, so they go in the default
+const defaultRunnerGroupId = 1
+
+// resolveScope works out where a job's runner gets registered. On org, jobs from one of github.orgs go
+// to that org and everything else to github.organization. On auto, enterprise jobs go to the
+// enterprise if it's the one we're set up for, other org jobs go to their org, and repos in
+// personal accounts get a runner of their own.
+func resolveScope(event *github.WorkflowJobEvent, enterprise string) (scope string, target string) {
+	switch githubScope {
+	case ScopeOrg:
+		if org := event.GetOrg().GetLogin(); org != "" && getOrg(org) != defaultOrg {
+			return ScopeOrg, org
+		}
+		return ScopeOrg, githubOrganization
+	case ScopeRepo:
+		return ScopeRepo, event.GetRepo().GetFullName()
+	case ScopeEnterprise:
+		return ScopeEnterprise, githubEnterprise
+	}
+
+	if githubEnterprise != "" && strings.EqualFold(enterprise, githubEnterprise) {
+		return ScopeEnterprise, githubEnterprise
+	}
+	if event.GetOrg().GetLogin() != "" {
+		return ScopeOrg, event.GetOrg().GetLogin()
+	}
+	return ScopeRepo, event.GetRepo().GetFullName()
+}
+
+// defaultScope is where runners go for jobs which didn't say, i.e. queued by an older version
+func defaultScope() (string, string) {
+	if githubScope == ScopeEnterprise {
+		return ScopeEnterprise, githubEnterprise
+	}
+	return ScopeOrg, githubOrganization
+}
+
+// newGithubRunnerName names the runner after the job it's for, with a random suffix so a retry, or a
+// registration left behind by an earlier attempt, can't collide with it
+func newGithubRunnerName(job QueuedJob) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	id := job.RunId
+	if job.JobId != 0 {
+		id = strconv.FormatInt(job.JobId, 10)
+	}
+	return fmt.Sprintf("%s-%s-%s", githubRunnerPrefix, id, hex.EncodeToString(b))
+}
+
+// GetJITConfig registers a runner with the name, returning the config to start it with along with its id
+func GetJITConfig(ctx context.Context, org *OrgConfig, scope string, target string, name string) (*github.JITRunnerConfig, error) {
+	if scope == "" {
+		scope, target = defaultScope()
+	}
+
+	groupId, err := GetRunnerGroupId(ctx, org, scope, target)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	config, response, err := githubClient.Actions.GenerateOrgJITConfig(context.Background(), githubOrganization, &github.GenerateJITConfigRequest{
-		Name:          fmt.Sprintf("%s-%d", githubRunnerPrefix, id),
-		Labels:        []string{githubLabel},
+	request := &github.GenerateJITConfigRequest{
+		Name:          name,
+		Labels:        []string{org.Label},
 		RunnerGroupID: groupId,
-	})
+	}
+
+	var config *github.JITRunnerConfig
+	var response *github.Response
+	switch scope {
+	case ScopeEnterprise:
+		config, response, err = org.Client.Enterprise.GenerateEnterpriseJITConfig(ctx, target, request)
+	case ScopeRepo:
+		owner, repo, _ := strings.Cut(target, "/")
+		config, response, err = org.Client.Actions.GenerateRepoJITConfig(ctx, owner, repo, request)
+	default:
+		config, response, err = org.Client.Actions.GenerateOrgJITConfig(ctx, target, request)
+	}
 	defer CloseGithubResponse(response)
 	if err != nil {
-		return "", err
+		//the group may have been deleted or recreated since we looked it up
+		forgetRunnerGroupId(org, scope, target)
+		return nil, err
 	}
 
-	return config.GetEncodedJITConfig(), err
+	return config, err
 }
 
-func GetRunnerGroupId() (int64, error) {
-	groups, response, err := githubClient.Actions.ListOrganizationRunnerGroups(context.Background(), githubOrganization, &github.ListOrgRunnerGroupOptions{})
-	defer CloseGithubResponse(response)
-	if err != nil {
-		return 0, err
-	}
-	for _, g := range groups.RunnerGroups {
-		if *g.Name == githubGroup {
-			return *g.ID, nil
-		}
+// RemoveGithubRunner deregisters the runner. Runners which already went away on their own are fine.
+func RemoveGithubRunner(ctx context.Context, org *OrgConfig, scope string, target string, id int64) error {
+	if scope == "" {
+		scope, target = defaultScope()
 	}
 
-	return 0, errors.New("runner group not found")
+	var response *github.Response
+	var err error
+	switch scope {
+	case ScopeEnterprise:
+		response, err = org.Client.Enterprise.RemoveRunner(ctx, target, id)
+	case ScopeRepo:
+		owner, repo, _ := strings.Cut(target, "/")
+		response, err = org.Client.Actions.RemoveRunner(ctx, owner, repo, id)
+	default:
+		response, err = org.Client.Actions.RemoveOrganizationRunner(ctx, target, id)
+	}
+	defer CloseGithubResponse(response)
+	if response != nil && response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
 }
 
 // CloseGithubResponse GitHub's wrapper means we can't use our own one...
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"golang.org/x/crypto/ssh"
+	"log/slog"
+	"time"
+)
+
+// JobHooks are local scripts which get copied onto the VM and run around the runner itself.
+// hooks.pre, hooks.post and hooks.timeout are the defaults, each org can set its own, see OrgConfig.
+type JobHooks struct {
+	Pre     string        `json:"pre,omitempty"`
+	Post    string        `json:"post,omitempty"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+var defaultHooks = loadHooks("hooks", JobHooks{Timeout: 300 * time.Second})
+
+// loadHooks reads <prefix>.pre, .post and .timeout, anything not set comes from fallback
+func loadHooks(prefix string, fallback JobHooks) JobHooks {
+	return JobHooks{
+		Pre:     env.GetOr(prefix+".pre", fallback.Pre),
+		Post:    env.GetOr(prefix+".post", fallback.Post),
+		Timeout: time.Duration(env.GetIntOr(prefix+".timeout", int(fallback.Timeout/time.Second))) * time.Second,
+	}
+}
+
+// runHook uploads the script to the VM and runs it, doing nothing if no script is configured
+func runHook(client *ssh.Client, runner *Runner, name string, source string, timeout time.Duration, logger *slog.Logger) error {
+	if source == "" {
+		return nil
+	}
+
+	logger.Info("Running hook", "hook", name)
+	target := fmt.Sprintf(".%s-job-hook", name)
+	err := uploadFile(client, source, target)
+	if err == nil {
+		err = executeCommandWithTimeout(client, fmt.Sprintf("chmod +x %s && ./%s; rc=$?; rm -f %s; exit $rc", target, target, target), logger, timeout)
+	}
+	if err != nil {
+		logger.Error("Hook failed", "hook", name, "error", err)
+		err = fmt.Errorf("%s-job hook failed: %w", name, err)
+		runner.SetError(err)
+		runner.Save()
+		return err
+	}
+	return nil
+}
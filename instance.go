@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// InstanceId identifies this process to everything else sharing redis
+var InstanceId = newInstanceId()
+
+var instanceHeartbeat = 20 * time.Second
+var instanceExpiry = time.Minute
+var heartbeatStopped atomic.Bool
+
+func newInstanceId() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+func instanceKey(id string) string {
+	return "instance:" + id
+}
+
+// StartHeartbeat keeps this instance marked alive, so others know not to touch the runners it owns
+func StartHeartbeat() {
+	beat := func() {
+		err := rdb.Set(context.Background(), instanceKey(InstanceId), time.Now().Format(time.RFC3339), instanceExpiry).Err()
+		if err != nil {
+			runnerLogger.Error("Failed to send heartbeat", "error", err)
+		}
+	}
+
+	beat()
+	go func() {
+		for {
+			time.Sleep(instanceHeartbeat)
+			if heartbeatStopped.Load() {
+				return
+			}
+			beat()
+		}
+	}()
+}
+
+// StopHeartbeat marks this instance as gone, so the reconciler can take over whatever it left behind
+func StopHeartbeat() {
+	heartbeatStopped.Store(true)
+	if err := rdb.Del(context.Background(), instanceKey(InstanceId)).Err(); err != nil {
+		runnerLogger.Error("Failed to remove heartbeat", "error", err)
+	}
+}
+
+func isInstanceAlive(id string) bool {
+	if id == InstanceId {
+		return true
+	}
+	count, err := rdb.Exists(context.Background(), instanceKey(id)).Result()
+	//if we can't tell, assume it's alive. Wrongly deleting a VM is worse than leaving one around.
+	return err != nil || count > 0
+}
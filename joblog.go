@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var logDir = env.Get("log.dir")
+
+// JobLog is the log for a single runner, from cloning the VM through to deleting it
+type JobLog struct {
+	Id     string
+	Logger *slog.Logger
+	file   *os.File
+}
+
+// newRunnerId generates the id we track a runner by. Run ids are shared between jobs, so these need a suffix.
+func newRunnerId(githubRunId string) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", githubRunId, hex.EncodeToString(b))
+}
+
+func NewJobLog(id string, redacted []string) (*JobLog, error) {
+	file, err := os.Create(logPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobLog{
+		Id:     id,
+		Logger: slog.New(newLogHandler(NewRedactor(io.MultiWriter(os.Stdout, file), redacted))).With("component", "runner", "runner", id),
+		file:   file,
+	}, nil
+}
+
+func (j *JobLog) Close() {
+	Close(j.file)
+	finishLog(j.Id)
+}
+
+// isLogActive is if the log is still being written to. Logs are named after their runner, and the
+// runner is tracked in redis, so this works from any instance sharing the log directory.
+func isLogActive(id string) bool {
+	runner, err := getRunner(id)
+	return err == nil && runner != nil && runner.IsActive() && !runner.IsAbandoned()
+}
+
+func logPath(id string) string {
+	return filepath.Join(logDir, id+".log")
+}
+
+// isValidLogId makes sure an id coming from a request can't walk out of the log directory
+func isValidLogId(id string) bool {
+	return id != "" && filepath.Base(id) == id && !strings.HasPrefix(id, ".")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// vmKeys holds the private half of the keypair generated for each VM.
+// These only ever live in memory, once the VM is deleted the key is gone.
+var vmKeys = make(map[int]ssh.Signer)
+var vmKeysLock sync.Mutex
+
+// newVMKey generates a fresh keypair for the given VM, replacing any key we had for it
+func newVMKey(vmid int) (ssh.Signer, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	vmKeysLock.Lock()
+	defer vmKeysLock.Unlock()
+	vmKeys[vmid] = signer
+	return signer, nil
+}
+
+func getVMKey(vmid int) (ssh.Signer, error) {
+	vmKeysLock.Lock()
+	defer vmKeysLock.Unlock()
+	signer, exists := vmKeys[vmid]
+	if !exists {
+		return nil, fmt.Errorf("no ssh key for vm %d", vmid)
+	}
+	return signer, nil
+}
+
+func discardVMKey(vmid int) {
+	vmKeysLock.Lock()
+	defer vmKeysLock.Unlock()
+	delete(vmKeys, vmid)
+}
+
+// encodeSshKeys url encodes keys the way Proxmox checks sshkeys, which includes the + / and = base64 keys are full of.
+// Spaces have to be %20, Proxmox doesn't take + for them.
+func encodeSshKeys(keys string) string {
+	return strings.ReplaceAll(url.QueryEscape(keys), "+", "%20")
+}
+
+// authorizedKey formats the public key the way cloud-init wants it, with a comment so it can be traced back
+func authorizedKey(vmid int, signer ssh.Signer) string {
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	return fmt.Sprintf("%s %s%d", key, VmNamePrefix, vmid)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEncodeSshKeys(t *testing.T) {
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI+b/c= grs-100"
+	encoded := encodeSshKeys(key)
+
+	expected := "ssh-ed25519%20AAAAC3NzaC1lZDI1NTE5AAAAI%2Bb%2Fc%3D%20grs-100"
+	if encoded != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+	if strings.ContainsAny(encoded, "+/= ") {
+		t.Errorf("%s still has characters Proxmox rejects", encoded)
+	}
+
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != key {
+		t.Errorf("expected %s back, got %s", key, decoded)
+	}
+}
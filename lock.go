@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// Locks shared between every scaler instance using the same redis
+const (
+	ProvisionLock = "lock:provision"
+	ReconcileLock = "lock:reconcile"
+	RetentionLock = "lock:retention"
+)
+
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// only delete the lock if it's still ours, it may have expired and been taken by someone else
+var releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+type Lock struct {
+	Name  string
+	token string
+}
+
+// tryLock takes the lock if nobody else has it, returning nil if they do.
+// The ttl is a safety net for when the holder dies, not how long it's meant to be held.
+func tryLock(name string, ttl time.Duration) (*Lock, error) {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	token := InstanceId + "-" + hex.EncodeToString(b)
+
+	ok, err := rdb.SetNX(context.Background(), name, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Lock{Name: name, token: token}, nil
+}
+
+// waitForLock keeps trying for the lock until the timeout
+func waitForLock(ctx context.Context, name string, ttl time.Duration, timeout time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLock(name, ttl)
+		if lock != nil || err != nil {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	if err := releaseScript.Run(context.Background(), rdb, []string{l.Name}, l.token).Err(); err != nil {
+		runnerLogger.Error("Failed to release lock", "lock", l.Name, "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LogFormat is either text or json, LogLevel one of debug, info, warn or error
+var LogFormat = env.GetOr("log.format", "text")
+var LogLevel = env.GetOr("log.level", "info")
+
+var logLevel = parseLogLevel(LogLevel)
+
+func init() {
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout)))
+}
+
+func parseLogLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func newLogHandler(writer io.Writer) slog.Handler {
+	options := &slog.HandlerOptions{Level: logLevel}
+	if strings.EqualFold(LogFormat, "json") {
+		return slog.NewJSONHandler(writer, options)
+	}
+	return slog.NewTextHandler(writer, options)
+}
+
+// newLogger is the logger for one part of the scaler, everything it logs is tagged with the component
+func newLogger(component string) *slog.Logger {
+	return slog.New(newLogHandler(os.Stdout)).With("component", component)
+}
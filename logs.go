@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type LogInfo struct {
+	Id         string    `json:"id"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	Active     bool      `json:"active"`
+	Compressed bool      `json:"compressed"`
+}
+
+func registerLogRoutes(r gin.IRoutes) {
+	r.GET("/logs", listLogs)
+	r.GET("/logs/:id", getLog)
+	r.GET("/logs/:id/stream", streamLog)
+}
+
+func listLogs(c *gin.Context) {
+	files, err := listLogFiles()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logs := make([]LogInfo, 0, len(files))
+	for _, v := range files {
+		logs = append(logs, v.LogInfo)
+	}
+
+	//newest first, that's what people are usually after
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Modified.After(logs[j].Modified)
+	})
+	c.JSON(http.StatusOK, logs)
+}
+
+func getLog(c *gin.Context) {
+	file, ok := openLog(c)
+	if !ok {
+		return
+	}
+	defer Close(file)
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, file)
+}
+
+// streamLog sends the log as server-sent events, following it while the job is still running
+func streamLog(c *gin.Context) {
+	file, ok := openLog(c)
+	if !ok {
+		return
+	}
+	defer Close(file)
+
+	id := c.Param("id")
+	reader := bufio.NewReader(file)
+	var partial string
+
+	c.Header("Cache-Control", "no-cache")
+	for {
+		//check before reading, otherwise the last lines can land between hitting EOF and the job finishing
+		active := isLogActive(id)
+		for {
+			line, err := reader.ReadString('\n')
+			if errors.Is(err, io.EOF) {
+				//hold onto half-written lines until the rest shows up
+				partial += line
+				break
+			}
+			if err != nil {
+				c.SSEvent("error", err.Error())
+				return
+			}
+			c.SSEvent("line", strings.TrimRight(partial+line, "\r\n"))
+			partial = ""
+		}
+
+		if !active {
+			if partial != "" {
+				c.SSEvent("line", partial)
+			}
+			c.SSEvent("end", id)
+			return
+		}
+
+		c.Writer.Flush()
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// openLog opens the log named in the request, decompressing it if it's already been finished off
+func openLog(c *gin.Context) (io.ReadCloser, bool) {
+	id := c.Param("id")
+	if !isValidLogId(id) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid log id"})
+		return nil, false
+	}
+
+	file, err := os.Open(logPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		var reader io.ReadCloser
+		reader, err = openCompressedLog(id)
+		if err == nil {
+			return reader, true
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "log not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return file, true
+}
+
+func openCompressedLog(id string) (io.ReadCloser, error) {
+	file, err := os.Open(logPath(id) + ".gz")
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		Close(file)
+		return nil, err
+	}
+	return &gzipLogReader{Reader: reader, file: file}, nil
+}
+
+// gzipLogReader closes the file along with the gzip stream
+type gzipLogReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipLogReader) Close() error {
+	_ = g.Reader.Close()
+	return g.file.Close()
+}
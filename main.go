@@ -2,33 +2,82 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v73/github"
 	"github.com/pufferpanel/github-runner-scaler/env"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 )
 
-var Label = env.Get("github.label")
-
 var rdb = redis.NewClient(&redis.Options{
 	Addr:     env.Get("redis.host"),
 	Password: env.Get("redis.password"),
 	DB:       0, // use default DB
 })
 
-var GithubSecretToken = []byte(env.Get("github.secret"))
-var webLogger = log.New(os.Stdout, "[Web] ", log.LstdFlags|log.Lmicroseconds)
+var webLogger = newLogger("web")
 
 func main() {
-	r := gin.Default()
+	command := "serve"
+	var args []string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+		args = os.Args[2:]
+	}
+
+	cmd, exists := commands[command]
+	if !exists {
+		printUsage()
+		os.Exit(2)
+	}
+
+	stopTracing := startTracing()
+	err := cmd.Run(args)
+	stopTracing()
+	if err != nil {
+		slog.Error("Command failed", "command", command, "error", err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the webhook receiver, plus the workers unless told otherwise
+func serve(withWorkers bool) error {
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if len(GithubSecrets) == 0 {
+		return ErrNoWebhookSecret
+	}
+	guard, err := webhookGuard()
+	if err != nil {
+		return err
+	}
+
+	r := gin.New()
+	r.Use(accessLog, gin.Recovery())
+	if err = r.SetTrustedProxies(WebTrustedProxies); err != nil {
+		return err
+	}
 
-	r.POST("/queue", func(c *gin.Context) {
-		payload, err := github.ValidatePayload(c.Request, GithubSecretToken)
+	r.POST("/queue", guard, func(c *gin.Context) {
+		ctx, span := tracer.Start(c.Request.Context(), "webhook", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("github.event", github.WebHookType(c.Request))))
+		defer span.End()
+
+		payload, err := validateWebhook(c.Request)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
@@ -39,45 +88,151 @@ func main() {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		//the delivery id is what ties everything this webhook causes back together
+		delivery := github.DeliveryID(c.Request)
+		if delivery == "" {
+			delivery = newDeliveryId()
+		}
+		span.SetAttributes(attribute.String("github.delivery", delivery))
+
+		var action struct {
+			Action string `json:"action"`
+		}
+		_ = json.Unmarshal(payload, &action)
+		countWebhookEvent(ctx, github.WebHookType(c.Request), action.Action)
+
 		switch event := event.(type) {
 		case *github.WorkflowJobEvent:
-			onWorkflowJob(event)
+			onWorkflowJob(ctx, event, delivery, enterpriseSlug(payload))
+		case *github.PingEvent:
+			onPing(event)
+		case *github.InstallationEvent:
+			onInstallation(ctx, event)
 		}
 
 		c.Status(http.StatusAccepted)
 	})
 
-	StartWorkers()
-	err := r.Run()
+	if AdminToken != "" {
+		admin := r.Group("/", requireAdmin)
+		registerLogRoutes(admin)
+		registerAdminRoutes(admin)
+		registerMetricRoutes(admin)
+		registerDashboard(r)
+	} else {
+		webLogger.Warn("No admin token set, admin endpoints are disabled")
+	}
+
+	if withWorkers {
+		StartWorkers(ctx)
+	}
+
+	server := &http.Server{Addr: ":" + env.GetOr("port", "8080"), Handler: r}
+	go func() {
+		<-ctx.Done()
+		webLogger.Info("Shutting down web server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	err = server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		panic(err)
+		return err
 	}
+
+	if withWorkers {
+		StopWorkers()
+	}
+	return nil
 }
 
-func onWorkflowJob(request *github.WorkflowJobEvent) {
+// accessLog logs each request without its query string, the admin token can be in there
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	webLogger.Info("Request", "method", c.Request.Method, "path", c.Request.URL.Path, "status", c.Writer.Status(),
+		"latency", time.Since(start), "client_ip", c.ClientIP())
+}
+
+func onWorkflowJob(ctx context.Context, request *github.WorkflowJobEvent, delivery string, enterprise string) {
 	if request.WorkflowJob == nil {
 		return
 	}
 
-	if !contains(request.WorkflowJob.Labels, Label) {
+	//each org can use its own label, jobs without it aren't ours
+	if !contains(request.WorkflowJob.Labels, getOrg(request.GetOrg().GetLogin()).Label) {
 		return
 	}
 
+	job := NewQueuedJob(fmt.Sprintf("%d", request.WorkflowJob.GetRunID()), delivery)
+	job.JobId = request.WorkflowJob.GetID()
+	job.JobName = request.WorkflowJob.GetName()
+	job.Workflow = request.WorkflowJob.GetWorkflowName()
+	job.Repo = request.GetRepo().GetFullName()
+	job.Labels = request.WorkflowJob.Labels
+	job.HeadSha = request.WorkflowJob.GetHeadSHA()
+	job.RunnerName = request.WorkflowJob.GetRunnerName()
+	job.Conclusion = request.WorkflowJob.GetConclusion()
+	job.Org = request.GetOrg().GetLogin()
+	job.Scope, job.Target = resolveScope(request, enterprise)
+
 	var queue = ""
-	if *request.Action == "queued" {
+	switch request.GetAction() {
+	case "queued":
 		queue = QueueName
-	} else if *request.Action == "completed" {
+		rdb.HDel(ctx, WaitingJobsKey, jobField(job.JobId))
+	case "completed":
 		queue = DeleteQueueName
+	case "in_progress":
+		onJobInProgress(ctx, job, request)
+	case "waiting":
+		onJobWaiting(ctx, job)
 	}
 
 	if queue == "" {
 		return
 	}
 
+	//only new jobs go through the policy, anything already running still needs cleaning up
+	if queue == QueueName {
+		if rejection := checkPolicy(request); rejection != nil {
+			webLogger.Warn("Job rejected by policy", append(job.logAttrs(), "rule", rejection.Rule, "value", rejection.Value)...)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("policy.rejected", rejection.Rule))
+			countPolicyRejection(ctx, rejection)
+			return
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "enqueue", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(append(job.spanAttrs(), attribute.String("queue", queue))...))
+	defer span.End()
+	job.TraceContext = injectTraceContext(ctx)
+
 	//this is a job we care about, let's start our queue stuff
 	//push it to redis, it will handle the queue
-	webLogger.Printf("Adding %d to queue", *request.WorkflowJob.RunID)
-	rdb.RPush(context.Background(), queue, fmt.Sprintf("%d", *request.WorkflowJob.RunID))
+	webLogger.Info("Adding job to queue", append(job.logAttrs(), "queue", queue, "action", request.GetAction())...)
+	var err error
+	if queue == QueueName {
+		err = enqueueJob(ctx, job)
+	} else {
+		err = rdb.RPush(ctx, queue, job.encode()).Err()
+	}
+	if err != nil {
+		webLogger.Error("Failed to queue job", append(job.logAttrs(), "error", err)...)
+		endSpan(span, err)
+	}
+}
+
+// enterpriseSlug is the enterprise the webhook came from, if any. The go-github events don't carry it.
+func enterpriseSlug(payload []byte) string {
+	var data struct {
+		Enterprise struct {
+			Slug string `json:"slug"`
+		} `json:"enterprise"`
+	}
+	_ = json.Unmarshal(payload, &data)
+	return data.Enterprise.Slug
 }
 
 func contains(s []string, e string) bool {
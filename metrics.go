@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// metric is one line of the Prometheus text format
+type metric struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// metricHelp describes everything we export, in the order it's written out
+var metricHelp = [][2]string{
+	{"scaler_jobs_queued", "Jobs waiting for a runner"},
+	{"scaler_jobs_retrying", "Jobs waiting out a backoff before another attempt"},
+	{"scaler_jobs_waiting", "Jobs held up on an approval or protection rule before they're queued"},
+	{"scaler_runners", "Runners still going, by state"},
+	{"scaler_runners_unassigned", "Runners up and waiting to pick up a job"},
+	{"scaler_webhook_events_total", "Webhooks received, by event and action"},
+	{"scaler_github_installation", "Where the app is installed, by account and the last thing that happened to it"},
+	{"scaler_github_ratelimit_limit", "Calls allowed per window by the GitHub rate limit"},
+	{"scaler_github_ratelimit_remaining", "Calls left in the current GitHub rate limit window"},
+	{"scaler_github_ratelimit_reset_timestamp_seconds", "When the GitHub rate limit window resets"},
+	{"scaler_github_ratelimit_throttled_total", "Calls held back waiting on the GitHub rate limit"},
+}
+
+func registerMetricRoutes(r gin.IRoutes) {
+	r.GET("/metrics", func(c *gin.Context) {
+		metrics, err := collectMetrics(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.String(http.StatusOK, formatMetrics(metrics))
+	})
+}
+
+func collectMetrics(c *gin.Context) ([]metric, error) {
+	ctx := c.Request.Context()
+	var result []metric
+
+	queued, err := countPendingJobs()
+	if err != nil {
+		return nil, err
+	}
+	retrying, err := rdb.ZCard(ctx, RetryQueueName).Result()
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := rdb.HLen(ctx, WaitingJobsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	result = append(result,
+		metric{"scaler_jobs_queued", nil, float64(queued)},
+		metric{"scaler_jobs_retrying", nil, float64(retrying)},
+		metric{"scaler_jobs_waiting", nil, float64(waiting)},
+	)
+
+	runners, err := listRunners()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]int)
+	var unassigned int
+	for _, v := range runners {
+		if !v.IsActive() {
+			continue
+		}
+		states[v.State]++
+		if v.State == StateRunning && v.Assignment == nil {
+			unassigned++
+		}
+	}
+	for k, v := range states {
+		result = append(result, metric{"scaler_runners", map[string]string{"state": k}, float64(v)})
+	}
+	result = append(result, metric{"scaler_runners_unassigned", nil, float64(unassigned)})
+
+	events, err := rdb.HGetAll(ctx, WebhookEventsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range events {
+		event, action, _ := strings.Cut(k, ":")
+		count, _ := strconv.ParseFloat(v, 64)
+		result = append(result, metric{"scaler_webhook_events_total", map[string]string{"event": event, "action": action}, count})
+	}
+
+	installations, err := rdb.HGetAll(ctx, InstallationsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range installations {
+		result = append(result, metric{"scaler_github_installation", map[string]string{"account": k, "action": v}, 1})
+	}
+
+	limits, err := getRateLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range limits {
+		labels := map[string]string{"instance": v.Instance, "client": v.Client, "resource": v.Resource}
+		result = append(result,
+			metric{"scaler_github_ratelimit_limit", labels, float64(v.Limit)},
+			metric{"scaler_github_ratelimit_remaining", labels, float64(v.Remaining)},
+			metric{"scaler_github_ratelimit_reset_timestamp_seconds", labels, float64(v.Reset.Unix())},
+			metric{"scaler_github_ratelimit_throttled_total", labels, float64(v.Throttled)},
+		)
+	}
+
+	return result, nil
+}
+
+func formatMetrics(metrics []metric) string {
+	var builder strings.Builder
+	for _, help := range metricHelp {
+		fmt.Fprintf(&builder, "# HELP %s %s\n", help[0], help[1])
+		kind := "gauge"
+		if strings.HasSuffix(help[0], "_total") {
+			kind = "counter"
+		}
+		fmt.Fprintf(&builder, "# TYPE %s %s\n", help[0], kind)
+		for _, v := range metrics {
+			if v.name == help[0] {
+				fmt.Fprintf(&builder, "%s%s %g\n", v.name, formatLabels(v.labels), v.value)
+			}
+		}
+	}
+	return builder.String()
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
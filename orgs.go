@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/bartventer/httpcache"
+	"github.com/google/go-github/v73/github"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GithubOrgNames are orgs served on top of github.organization, each configured with
+// github.org.<name>.token, .label, .group, .max, .status and .cancel.after. Anything not set falls back to the github.* value.
+// Each org is also a profile for what runs on its VMs, with its own github.org.<name>.hooks.* and
+// github.org.<name>.runner.*
+var GithubOrgNames = splitList(env.Get("github.orgs"))
+
+// GithubStatus and GithubCancelAfter are what orgs not setting their own do about failing to provision,
+// see OrgConfig. 0 never cancels.
+var GithubStatus = env.GetBool("github.status")
+var GithubCancelAfter = env.GetInt("github.cancel.after")
+
+// GithubMax is how many runners github.organization, and any org without its own limit, can have at once.
+// 0 is no limit, beyond how many VMs we can run.
+var GithubMax = env.GetInt("github.max")
+
+// OrgConfig is everything that differs between the orgs we serve
+type OrgConfig struct {
+	Name   string         `json:"name"`
+	Label  string         `json:"label"`
+	Group  string         `json:"group"`
+	Max    int            `json:"max"`
+	Client *github.Client `json:"-"`
+	//limiter is what Client has seen of the rate limit
+	limiter *rateLimitTransport
+
+	//Status sets a commit status when provisioning fails, CancelAfter cancels the run after that many failed attempts
+	Status      bool `json:"status"`
+	CancelAfter int  `json:"cancelAfter"`
+
+	//Hooks run on the org's VMs around the runner
+	Hooks JobHooks `json:"hooks"`
+
+	//RunnerEnv and RunnerSecrets are injected into the org's VMs on top of runner.env and runner.secrets, see loadRunnerEnv
+	RunnerEnv     []string `json:"runnerEnv,omitempty"`
+	RunnerSecrets []string `json:"runnerSecrets,omitempty"`
+}
+
+// defaultOrg is github.organization, and what's used for anything not from a configured org
+var defaultOrg = &OrgConfig{
+	Name:   githubOrganization,
+	Label:  githubLabel,
+	Group:  githubGroup,
+	Max:    GithubMax,
+	Client: githubClient,
+
+	limiter: githubRateLimiter,
+
+	Status:      GithubStatus,
+	CancelAfter: GithubCancelAfter,
+
+	Hooks: defaultHooks,
+}
+
+var orgConfigs = loadOrgConfigs()
+
+// newGithubClient creates a client for the token, named for reporting its rate limits
+func newGithubClient(name string, token string) (*github.Client, *rateLimitTransport) {
+	limiter := newRateLimitTransport(name, http.DefaultTransport)
+	return github.NewClient(httpcache.NewClient("memcache://", httpcache.WithUpstream(limiter))).WithAuthToken(token), limiter
+}
+
+// rateLimitDelay is how long before the org's token can be used again, 0 if it can be now
+func (o *OrgConfig) rateLimitDelay() time.Duration {
+	if o.limiter == nil {
+		return 0
+	}
+	return max(o.limiter.blockedFor(), 0)
+}
+
+func loadOrgConfigs() map[string]*OrgConfig {
+	result := map[string]*OrgConfig{strings.ToLower(defaultOrg.Name): defaultOrg}
+	for _, v := range GithubOrgNames {
+		org := &OrgConfig{
+			Name:   v,
+			Label:  env.GetOr("github.org."+v+".label", defaultOrg.Label),
+			Group:  env.GetOr("github.org."+v+".group", defaultOrg.Group),
+			Max:    env.GetIntOr("github.org."+v+".max", GithubMax),
+			Client: defaultOrg.Client,
+
+			limiter: defaultOrg.limiter,
+
+			Status:      env.GetBoolOr("github.org."+v+".status", GithubStatus),
+			CancelAfter: env.GetIntOr("github.org."+v+".cancel.after", GithubCancelAfter),
+
+			Hooks: loadHooks("github.org."+v+".hooks", defaultHooks),
+
+			RunnerEnv:     splitList(env.Get("github.org." + v + ".runner.env")),
+			RunnerSecrets: splitList(env.Get("github.org." + v + ".runner.secrets")),
+		}
+		if token := env.Get("github.org." + v + ".token"); token != "" {
+			org.Client, org.limiter = newGithubClient(v, token)
+		}
+		result[strings.ToLower(v)] = org
+	}
+	return result
+}
+
+// getOrg is the config for the org, or the defaults if it isn't one we know
+func getOrg(name string) *OrgConfig {
+	if org, exists := orgConfigs[strings.ToLower(name)]; exists {
+		return org
+	}
+	return defaultOrg
+}
+
+// orgFor is whose config applies to runners registered at the scope, for when there's no org to go by.
+// Repos use their owner's, enterprises the defaults.
+func orgFor(scope string, target string) *OrgConfig {
+	switch scope {
+	case ScopeOrg:
+		return getOrg(target)
+	case ScopeRepo:
+		owner, _, _ := strings.Cut(target, "/")
+		return getOrg(owner)
+	}
+	return defaultOrg
+}
+
+// org is whose config applies to the job. That's the org the webhook came from, even when the runner
+// is registered on the enterprise, so each org keeps its own label, group and limit.
+func (j QueuedJob) org() *OrgConfig {
+	if j.Org != "" {
+		return getOrg(j.Org)
+	}
+	scope, target := j.Scope, j.Target
+	if scope == "" {
+		scope, target = defaultScope()
+	}
+	return orgFor(scope, target)
+}
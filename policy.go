@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-github/v73/github"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PolicyRejectionsKey counts rejected jobs by the rule which rejected them
+const PolicyRejectionsKey = "policy_rejections"
+
+// PolicyRule lets through values matching any of Allow, unless they match any of Deny.
+// An empty Allow lets everything through. Patterns are globs, i.e. myorg/* or .github/workflows/ci-*.yml
+type PolicyRule struct {
+	Name  string   `json:"name"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// each rule is configured with policy.<name>.allow and policy.<name>.deny
+var policyRules = []PolicyRule{
+	loadPolicyRule("repos"),
+	loadPolicyRule("workflows"),
+	loadPolicyRule("branches"),
+	loadPolicyRule("events"),
+	loadPolicyRule("actors"),
+	loadPolicyRule("visibility"),
+}
+
+// PolicyAllowForks lets pull requests from forks have runners. Anyone can open one, so it's off unless asked for.
+var PolicyAllowForks = env.GetBool("policy.forks")
+
+func loadPolicyRule(name string) PolicyRule {
+	return PolicyRule{
+		Name:  name,
+		Allow: splitList(env.Get("policy." + name + ".allow")),
+		Deny:  splitList(env.Get("policy." + name + ".deny")),
+	}
+}
+
+func (r PolicyRule) configured() bool {
+	return len(r.Allow) > 0 || len(r.Deny) > 0
+}
+
+func (r PolicyRule) allows(value string) bool {
+	if matchesAny(r.Deny, value) {
+		return false
+	}
+	return len(r.Allow) == 0 || matchesAny(r.Allow, value)
+}
+
+func matchesAny(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, v := range patterns {
+		if matched, _ := path.Match(strings.ToLower(v), value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyRejection is why a job wasn't given a runner
+type PolicyRejection struct {
+	Rule  string
+	Value string
+}
+
+func (p *PolicyRejection) Error() string {
+	return fmt.Sprintf("rejected by %s policy (%s)", p.Rule, p.Value)
+}
+
+// checkPolicy decides if the job gets a runner, going by what's on the webhook. The workflow path, event and
+// where the code came from are only on the workflow run, checkRunPolicy looks at those.
+func checkPolicy(event *github.WorkflowJobEvent) *PolicyRejection {
+	repo := event.GetRepo()
+	visibility := repo.GetVisibility()
+	if visibility == "" {
+		visibility = "public"
+		if repo.GetPrivate() {
+			visibility = "private"
+		}
+	}
+
+	values := map[string]string{
+		"repos":      repo.GetFullName(),
+		"branches":   event.WorkflowJob.GetHeadBranch(),
+		"actors":     event.GetSender().GetLogin(),
+		"visibility": visibility,
+	}
+
+	return checkPolicyValues(values)
+}
+
+// checkRunPolicy checks the rules which need the workflow run. Looking that up can be slow or wait on the
+// rate limit, so it's done by the worker rather than the webhook. An error means the run couldn't be looked up
+// and the job should be tried again, not that it's been rejected.
+func checkRunPolicy(ctx context.Context, job QueuedJob) (*PolicyRejection, error) {
+	if !policyRuleConfigured("workflows") && !policyRuleConfigured("events") && PolicyAllowForks {
+		return nil, nil
+	}
+
+	//jobs from older versions, or requeued without one, don't know their repo so there's no run to look up
+	owner, repo, found := strings.Cut(job.Repo, "/")
+	if !found {
+		return nil, nil
+	}
+	runId, err := strconv.ParseInt(job.RunId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	run, response, err := job.org().Client.Actions.GetWorkflowRunByID(ctx, owner, repo, runId)
+	CloseGithubResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	if head := run.GetHeadRepository().GetFullName(); !PolicyAllowForks && head != "" && !strings.EqualFold(head, job.Repo) {
+		return &PolicyRejection{Rule: "forks", Value: head}, nil
+	}
+	return checkPolicyValues(map[string]string{
+		"workflows": run.GetPath(),
+		"events":    run.GetEvent(),
+	}), nil
+}
+
+// checkPolicyValues runs the rules we have values for, the rest are left for whichever check has them
+func checkPolicyValues(values map[string]string) *PolicyRejection {
+	for _, v := range policyRules {
+		if value, exists := values[v.Name]; exists && !v.allows(value) {
+			return &PolicyRejection{Rule: v.Name, Value: value}
+		}
+	}
+	return nil
+}
+
+func policyRuleConfigured(name string) bool {
+	for _, v := range policyRules {
+		if v.Name == name {
+			return v.configured()
+		}
+	}
+	return false
+}
+
+func countPolicyRejection(ctx context.Context, rejection *PolicyRejection) {
+	rdb.HIncrBy(ctx, PolicyRejectionsKey, rejection.Rule, 1)
+}
+
+// getPolicyRejections is how many jobs each rule has rejected
+func getPolicyRejections(ctx context.Context) (map[string]int64, error) {
+	values, err := rdb.HGetAll(ctx, PolicyRejectionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64)
+	for k, v := range values {
+		var count int64
+		_, _ = fmt.Sscan(v, &count)
+		result[k] = count
+	}
+	return result, nil
+}
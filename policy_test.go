@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckRunPolicyWithoutRepo(t *testing.T) {
+	rules, forks := policyRules, PolicyAllowForks
+	defer func() {
+		policyRules, PolicyAllowForks = rules, forks
+	}()
+	policyRules = []PolicyRule{{Name: "workflows", Allow: []string{".github/workflows/ci.yml"}}}
+	PolicyAllowForks = false
+
+	//there's no run to look up, so this mustn't go anywhere near GitHub
+	rejection, err := checkRunPolicy(context.Background(), NewQueuedJob("123", "delivery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejection != nil {
+		t.Errorf("expected the job through, got %v", rejection)
+	}
+}
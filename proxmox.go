@@ -3,25 +3,31 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/pkg/sftp"
 	"github.com/pufferpanel/github-runner-scaler/env"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 const VmNamePrefix = "github-workflow-"
 
+var ErrAtCapacity = errors.New("maximum number of VMs reached")
+
 var httpClient = &http.Client{}
 var NumWorkers = env.GetIntOr("workers", 3)
 var TemplateVmId = env.GetInt("proxmox.templateId")
@@ -31,14 +37,11 @@ var ProxmoxSftpHost = env.Get("proxmox.sftp.host")
 var ProxmoxSftpUser = env.Get("proxmox.sftp.user")
 var ProxmoxSftpPassword = env.Get("proxmox.sftp.password")
 var CloudInitUser = env.Get("cloudinit.ssh.user")
-var CloudInitKey ssh.Signer
-
-var logDir = env.Get("log.dir")
 
 var CloneVmUrl *url.URL
 var GetVmsUrl *url.URL
 
-var proxmoxLogger = log.New(os.Stdout, "[Proxmox] ", log.LstdFlags|log.Lmicroseconds)
+var proxmoxLogger = newLogger("proxmox")
 
 func init() {
 	var err error
@@ -51,48 +54,111 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+}
+
+func cloneVM(ctx context.Context, job QueuedJob) (err error) {
+	ctx, span := tracer.Start(ctx, "provision", trace.WithAttributes(job.spanAttrs()...))
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	key := env.Get("cloudinit.ssh.key")
-	CloudInitKey, err = ssh.ParsePrivateKey([]byte(key))
+	//only one instance picks an id and clones at a time, otherwise two can take the same id or go over the limit
+	lock, err := waitForLock(ctx, ProvisionLock, 2*time.Minute, time.Minute)
 	if err != nil {
-		panic(err)
+		return err
 	}
-}
+	defer lock.Release()
 
-func cloneVM(githubRunId string) error {
-	vms, err := getVMs()
+	vms, err := getVMs(ctx)
 	if err != nil {
 		return err
 	}
 
-	var currentId int
+	var currentId, numVms int
 	for _, vm := range vms {
 		if currentId < vm.Id {
 			currentId = vm.Id
 		}
+		if strings.HasPrefix(vm.Name, VmNamePrefix) {
+			numVms++
+		}
 	}
 	currentId++
 
+	if numVms >= NumWorkers {
+		return ErrAtCapacity
+	}
+
+	//checked again under the lock, two workers may have both picked the group's last slot
+	groups, orgs, err := activeCounts()
+	if err != nil {
+		return err
+	}
+	if group := groupForRepo(job.Repo); group.Max > 0 && groups[group.Name] >= group.Max {
+		return ErrGroupAtCapacity
+	}
+	if orgAtCapacity(job, orgs) {
+		return ErrOrgAtCapacity
+	}
+	span.SetAttributes(attribute.Int("proxmox.vmid", currentId), attribute.String("proxmox.node", ProxmoxNode))
+
+	//record the id before the VM exists, so the reconciler knows it's ours
+	runner := NewRunner(job)
+	runner.VMID = currentId
+	runner.Save()
+
+	runnerEnv, err := loadRunnerEnv(job.org())
+	if err != nil {
+		runner.Finish(err)
+		return err
+	}
+
+	jobLog, err := NewJobLog(runner.Id, runnerEnv.Redacted())
+	if err != nil {
+		runner.Finish(err)
+		return err
+	}
+	logger := jobLog.Logger.With(job.logAttrs()...).With("vmid", currentId, "node", ProxmoxNode)
+	logger.Info("Provisioning runner", "phase", "clone")
+
+	release := trackRunner()
+	fail := func(err error) error {
+		runner.Finish(err)
+		jobLog.Close()
+		release()
+		return err
+	}
+
 	b := new(bytes.Buffer)
 	err = json.NewEncoder(b).Encode(&CloneRequest{
 		NewId: currentId,
-		Name:  VmNamePrefix + githubRunId,
+		Name:  VmNamePrefix + job.RunId,
 	})
 	if err != nil {
-		return err
+		return fail(err)
 	}
 
-	taskId, err := doRequest[string](http.MethodPost, CloneVmUrl, b.Bytes())
+	logger.Info("Cloning template", "phase", "clone", "template", TemplateVmId)
+	taskId, err := doRequest[string](ctx, http.MethodPost, CloneVmUrl, b.Bytes())
+	if err != nil {
+		logger.Error("Error cloning VM", "phase", "clone", "error", err)
+		return fail(err)
+	}
+
+	//the VM exists now, so nobody else will pick its id
+	lock.Release()
 
 	//wait for task to complete
+	_, waitSpan := tracer.Start(ctx, "wait for clone task", trace.WithAttributes(attribute.String("proxmox.task", taskId)))
 	var done bool
 	for !done {
 		time.Sleep(10 * time.Second)
-		done, err = isTaskComplete(taskId)
+		done, err = isTaskComplete(ctx, taskId)
 		if err != nil {
-			proxmoxLogger.Printf("Error getting task %s status: %s", taskId, err.Error())
+			logger.Warn("Error getting task status", "phase", "clone", "task", taskId, "error", err)
 		}
 	}
+	endSpan(waitSpan, err)
 
 	//var snippet = fmt.Sprintf("snippets/%d.json", currentId)
 	//drop in the new snippet
@@ -111,32 +177,80 @@ func cloneVM(githubRunId string) error {
 
 	//just in case, rebuild the cloud init image
 	//do this in a function so things are closed here
-	//err = regenerateCloudInitImage(currentId)
+	//err = regenerateCloudInitImage(ctx, currentId)
 	//if err != nil {
 	//	proxmoxLogger.Printf("Error rebuilding cloudinit: %s", err)
 	//	return err
 	//}
 
+	//every VM gets its own key, so one leaking doesn't give access to the rest
+	logger.Info("Configuring ssh key", "phase", "clone")
+	key, err := newVMKey(currentId)
+	if err == nil {
+		err = setCloudInitKey(ctx, currentId, key)
+	}
+	if err == nil {
+		err = regenerateCloudInitImage(ctx, currentId)
+	}
+	if err != nil {
+		logger.Error("Error configuring ssh key", "phase", "clone", "error", err)
+		runner.SetState(StateDeleting)
+		deleteVM(ctx, currentId, logger.With("phase", "cleanup"))
+		return fail(err)
+	}
+
 	//start the VM
-	err = startVM(currentId)
+	logger.Info("Starting VM", "phase", "boot")
+	runner.SetState(StateBooting)
+	if err = startVM(ctx, currentId); err != nil {
+		logger.Error("Error starting VM", "phase", "boot", "error", err)
+		runner.SetState(StateDeleting)
+		deleteVM(ctx, currentId, logger.With("phase", "cleanup"))
+		return fail(err)
+	}
+
+	//the runner outlives provisioning, so it gets its own span
+	runnerCtx, runnerSpan := tracer.Start(ctx, "runner", trace.WithAttributes(job.spanAttrs()...))
+	runnerSpan.SetAttributes(attribute.Int("proxmox.vmid", currentId))
+
+	go func(id int) {
+		var err error
+		defer func() {
+			endSpan(runnerSpan, err)
+		}()
+		defer release()
+		defer jobLog.Close()
+		defer func() {
+			runner.SetState(StateDeleting)
+			deleteVM(runnerCtx, id, logger.With("phase", "cleanup"))
+			//GitHub removes the runner itself once it's done a job, otherwise it's left registered with nothing behind it
+			if err != nil {
+				runner.Deregister(context.Background(), logger.With("phase", "cleanup"))
+			}
+			runner.Finish(err)
 
-	go func(id int, runId string) {
-		defer deleteVM(id)
+			//the job never made it onto the runner, so give it another go on a fresh VM
+			if errors.Is(err, ErrRateLimited) {
+				delayJob(job, job.org().rateLimitDelay(), logger.With("reason", err))
+			} else if err != nil && runner.Started.IsZero() {
+				retryJob(job, err, logger)
+			}
+		}()
 
-		err := startGithubRunner(id, githubRunId)
+		err = startGithubRunner(runnerCtx, id, job, runner, runnerEnv, logger)
 		if err != nil {
-			proxmoxLogger.Printf("Error observing vm: %s", err)
+			logger.Error("Runner failed", "error", err)
 		}
-	}(currentId, githubRunId)
+	}(currentId)
 
-	return err
+	return nil
 }
 
-func getVMs() ([]VM, error) {
-	return doRequest[[]VM](http.MethodGet, GetVmsUrl, nil)
+func getVMs(ctx context.Context) ([]VM, error) {
+	return doRequest[[]VM](ctx, http.MethodGet, GetVmsUrl, nil)
 }
 
-func updateCloudInit(id int, path string) error {
+func updateCloudInit(ctx context.Context, id int, path string) error {
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/config", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
 		return err
@@ -154,26 +268,48 @@ func updateCloudInit(id int, path string) error {
 		return err
 	}
 
-	_, err = doRequest[None](http.MethodPut, u, buf.Bytes())
+	_, err = doRequest[None](ctx, http.MethodPut, u, buf.Bytes())
 	return err
 }
 
-func regenerateCloudInitImage(id int) error {
+func setCloudInitKey(ctx context.Context, id int, key ssh.Signer) error {
+	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/config", ProxmoxUrl, ProxmoxNode, id))
+	if err != nil {
+		return err
+	}
+
+	//proxmox wants the keys url encoded, on top of the json encoding
+	newConfig := &VM{
+		CloudInitUser: CloudInitUser,
+		SshKeys:       encodeSshKeys(authorizedKey(id, key)),
+	}
+
+	buf := new(bytes.Buffer)
+	err = json.NewEncoder(buf).Encode(&newConfig)
+	if err != nil {
+		return err
+	}
+
+	_, err = doRequest[None](ctx, http.MethodPut, u, buf.Bytes())
+	return err
+}
+
+func regenerateCloudInitImage(ctx context.Context, id int) error {
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/cloudinit", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
 		return err
 	}
-	_, err = doRequest[None](http.MethodPut, u, nil)
+	_, err = doRequest[None](ctx, http.MethodPut, u, nil)
 	return err
 }
 
-func isTaskComplete(id string) (bool, error) {
+func isTaskComplete(ctx context.Context, id string) (bool, error) {
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/tasks/%s/status", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
 		return false, err
 	}
 
-	response, err := doRequest[TaskStatus](http.MethodGet, u, nil)
+	response, err := doRequest[TaskStatus](ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return false, err
 	}
@@ -187,13 +323,13 @@ func isTaskComplete(id string) (bool, error) {
 	return false, err
 }
 
-func startVM(id int) error {
+func startVM(ctx context.Context, id int) error {
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/status/start", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
 		return err
 	}
 
-	_, err = doRequest[string](http.MethodPost, u, nil)
+	_, err = doRequest[string](ctx, http.MethodPost, u, nil)
 	return err
 }
 
@@ -237,12 +373,18 @@ func writeMetaCloudInit(filename string, data map[string]string) error {
 	return err
 }
 
-func doRequest[T interface{}](method string, url *url.URL, body []byte) (T, error) {
-	request := &http.Request{
+func doRequest[T interface{}](ctx context.Context, method string, url *url.URL, body []byte) (result T, err error) {
+	ctx, span := tracer.Start(ctx, "proxmox "+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", method), attribute.String("url.path", url.Path)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	request := (&http.Request{
 		Method: method,
 		URL:    url,
 		Header: make(http.Header),
-	}
+	}).WithContext(ctx)
 
 	if (method == http.MethodPost || method == http.MethodPut) && body == nil {
 		body = []byte("{}") //proxmox wants a junk json object for POSTs
@@ -260,20 +402,22 @@ func doRequest[T interface{}](method string, url *url.URL, body []byte) (T, erro
 	defer CloseResponse(response)
 	if err != nil || response.StatusCode >= 400 {
 		var data []byte
+		var statusCode int
 		if err != nil {
-			proxmoxLogger.Printf("Error from call: %s", err.Error())
 			data = []byte(err.Error())
 		} else {
+			statusCode = response.StatusCode
 			data, _ = io.ReadAll(response.Body)
 			_ = response.Body.Close()
 			response.Body = io.NopCloser(bytes.NewReader(data)) //replace body in case a downstream reader wants it
 			err = errors.New(string(data))
 		}
-		proxmoxLogger.Printf("%s: %s (%d) %s", request.Method, request.URL.String(), response.StatusCode, string(data))
+		proxmoxLogger.Error("Request failed", "method", request.Method, "url", request.URL.String(), "status", statusCode, "error", string(data))
 		return *new(T), err
 	} else {
-		proxmoxLogger.Printf("%s: %s (%d)", request.Method, request.URL.String(), response.StatusCode)
+		proxmoxLogger.Debug("Request", "method", request.Method, "url", request.URL.String(), "status", response.StatusCode)
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
 
 	type resType struct {
 		Data T `json:"data"`
@@ -284,78 +428,115 @@ func doRequest[T interface{}](method string, url *url.URL, body []byte) (T, erro
 	return res.Data, err
 }
 
-func startGithubRunner(vmid int, githubRunId string) error {
+func startGithubRunner(ctx context.Context, vmid int, job QueuedJob, runner *Runner, runnerEnv *RunnerEnv, logger *slog.Logger) error {
 	//first, get the IP of this VM
 	var ip string
 	var err error
 
+	bootLogger := logger.With("phase", "boot")
+	_, ipSpan := tracer.Start(ctx, "discover ip")
 	timeout := time.Now().Add(5 * time.Minute)
 	for ip == "" && time.Now().Before(timeout) {
-		ip, err = getVmIP(vmid)
+		ip, err = getVmIP(ctx, vmid)
 		if err != nil {
-			proxmoxLogger.Printf("Error determining VM IP: %s", err.Error())
+			bootLogger.Warn("Error determining VM IP", "error", err)
 			time.Sleep(time.Second * 10)
 			continue
 		}
 		if ip == "" {
-			proxmoxLogger.Printf("IP not found, re-trying")
+			bootLogger.Debug("IP not found, re-trying")
 			time.Sleep(time.Second * 10)
 			continue
 		}
 	}
 	if ip == "" {
-		return errors.New("failed to determine IP for VM")
+		err = errors.New("failed to determine IP for VM")
+		endSpan(ipSpan, err)
+		return err
 	}
+	ipSpan.SetAttributes(attribute.String("vm.ip", ip))
+	ipSpan.End()
 
 	//we got the ip, let's see how this goes!
+	bootLogger.Info("VM has IP, connecting", "ip", ip)
+	runner.IP = ip
+	runner.Save()
+
+	key, err := getVMKey(vmid)
+	if err != nil {
+		return err
+	}
+
+	_, sshSpan := tracer.Start(ctx, "ssh connect")
 	var client *ssh.Client
 	timeout = time.Now().Add(5 * time.Minute)
 	for client == nil && time.Now().Before(timeout) {
 		client, err = ssh.Dial("tcp", ip+":22", &ssh.ClientConfig{
 			User: CloudInitUser,
 			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(CloudInitKey),
+				ssh.PublicKeys(key),
 			},
 			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 				return nil
 			},
 		})
 		if err != nil {
-			proxmoxLogger.Printf("Error waiting for SSH: %s", err.Error())
+			bootLogger.Debug("Error waiting for SSH", "error", err)
 			time.Sleep(time.Second * 10)
 			continue
 		}
 	}
 	if client == nil {
-		return errors.New("failed to connect to SSH due to timeout")
+		err = errors.New("failed to connect to SSH due to timeout")
+		endSpan(sshSpan, err)
+		return err
 	}
+	sshSpan.End()
 	defer Close(client)
 
-	logFile, err := os.Create(filepath.Join(logDir, fmt.Sprintf("%s.log", githubRunId)))
-	if err != nil {
+	runner.Ready = time.Now()
+	runner.Save()
+
+	prepareLogger := logger.With("phase", "prepare")
+	prepareLogger.Info("Preparing runner")
+	if err = prepareRunner(client, prepareLogger); err != nil {
 		return err
 	}
-	defer Close(logFile)
-	logger := log.New(io.MultiWriter(os.Stdout, logFile), fmt.Sprintf("[VM-%d] ", vmid), 0)
-	logger.Printf("Run Id: %s", githubRunId)
 
-	logger.Println("Extracting runner")
-	if err = executeCommand(client, "tar -xzf /opt/runner-cache/actions-runner-*.tar.gz -C .", logger); err != nil {
+	if err = runnerEnv.inject(client, prepareLogger); err != nil {
 		return err
 	}
 
-	logger.Println("Getting runner config")
-	config, err := GetJITConfig(vmid)
-	if err != nil {
+	hooks := job.org().Hooks
+	if err = runHook(client, runner, "pre", hooks.Pre, hooks.Timeout, prepareLogger); err != nil {
 		return err
 	}
 
-	logger.Println("Starting runner")
-	if err = executeCommand(client, "./run.sh --jitconfig "+config, logger); err != nil {
+	prepareLogger.Info("Getting runner config")
+	config, err := GetJITConfig(ctx, job.org(), job.Scope, job.Target, newGithubRunnerName(job))
+	if err != nil {
 		return err
 	}
+	runner.GithubId = config.GetRunner().GetID()
+	runner.GithubName = config.GetRunner().GetName()
+	runner.Save()
 
-	return nil
+	runLogger := logger.With("phase", "run")
+	runLogger.Info("Starting runner")
+	runner.Started = time.Now()
+	runner.SetState(StateRunning)
+	reportRunnerStarted(ctx, job, runLogger)
+	_, runSpan := tracer.Start(ctx, "run job")
+	runErr := executeCommand(client, "./run.sh --jitconfig "+config.GetEncodedJITConfig(), runLogger)
+	endSpan(runSpan, runErr)
+	if runErr != nil {
+		runLogger.Error("Runner exited with error", "error", runErr)
+	}
+
+	//post hook runs no matter how the job went, that's when diagnostics are most useful
+	_ = runHook(client, runner, "post", hooks.Post, hooks.Timeout, logger.With("phase", "cleanup"))
+
+	return runErr
 }
 
 func uploadData(client *ssh.Client, target string, data io.Reader) error {
@@ -385,56 +566,90 @@ func uploadFile(client *ssh.Client, source string, target string) error {
 	return uploadData(client, target, sourceFile)
 }
 
-func executeCommand(client *ssh.Client, command string, logger *log.Logger) error {
+func executeCommand(client *ssh.Client, command string, logger *slog.Logger) error {
+	return executeCommandWithTimeout(client, command, logger, 0)
+}
+
+// executeCommandWithTimeout runs the command, killing it if it takes longer than timeout. A timeout of 0 waits forever.
+func executeCommandWithTimeout(client *ssh.Client, command string, logger *slog.Logger, timeout time.Duration) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return err
 	}
 	defer Close(session)
 
+	//pipes have to exist before the command starts, otherwise we lose output
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	//output is waited on before returning, so nothing gets logged about a command we've already moved on from
+	var output sync.WaitGroup
+	for name, pipe := range map[string]io.Reader{"stderr": stderr, "stdout": stdout} {
+		output.Add(1)
+		go func(name string, pipe io.Reader) {
+			defer output.Done()
+			reader := bufio.NewScanner(pipe)
+			for reader.Scan() {
+				logger.Info(reader.Text(), "stream", name)
+			}
+		}(name, pipe)
+	}
+
+	if err = session.Start(command); err != nil {
+		return err
+	}
+
+	if timeout <= 0 {
+		err = session.Wait()
+		output.Wait()
+		return err
+	}
+
+	done := make(chan error, 1)
 	go func() {
-		pipe, err := session.StderrPipe()
-		if err != nil {
-			logger.Printf("Failed to create stdout pipe: %s", err.Error())
-			return
-		}
-		reader := bufio.NewScanner(pipe)
-		for reader.Scan() {
-			logger.Print(reader.Text())
-		}
-	}()
-	go func() {
-		pipe, err := session.StdoutPipe()
-		if err != nil {
-			logger.Printf("Failed to create stdout pipe: %s", err.Error())
-			return
-		}
-		reader := bufio.NewScanner(pipe)
-		for reader.Scan() {
-			logger.Print(reader.Text())
-		}
+		done <- session.Wait()
 	}()
 
-	return session.Run(command)
+	select {
+	case err = <-done:
+		output.Wait()
+		return err
+	case <-time.After(timeout):
+		//not every server passes signals on, closing the session is what makes sure the output ends
+		_ = session.Signal(ssh.SIGKILL)
+		Close(session)
+		output.Wait()
+		return fmt.Errorf("command timed out after %s", timeout)
+	}
 }
 
-func getVmIP(id int) (string, error) {
-	//first, get the configured network interface we need
+func getVMConfig(ctx context.Context, id int) (VMConfig, error) {
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/config", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
-		return "", err
+		return VMConfig{}, err
 	}
-	config, err := doRequest[VMConfig](http.MethodGet, u, nil)
+	return doRequest[VMConfig](ctx, http.MethodGet, u, nil)
+}
+
+func getVmIP(ctx context.Context, id int) (string, error) {
+	//first, get the configured network interface we need
+	config, err := getVMConfig(ctx, id)
 	if err != nil {
 		return "", err
 	}
 	netIf := strings.ToLower(strings.TrimPrefix(strings.Split(config.Net, ",")[0], "virtio="))
 
-	u, err = url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/agent/network-get-interfaces", ProxmoxUrl, ProxmoxNode, id))
+	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/agent/network-get-interfaces", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
 		return "", err
 	}
-	agent, err := doRequest[QemuGuestAgentResult](http.MethodGet, u, nil)
+	agent, err := doRequest[QemuGuestAgentResult](ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return "", err
 	}
@@ -453,33 +668,37 @@ func getVmIP(id int) (string, error) {
 	return "", nil
 }
 
-func deleteVM(id int) {
+func deleteVM(ctx context.Context, id int, logger *slog.Logger) {
 	//to delete the VM, we need to stop it and then delete
 	//first, trigger the stop call. At this point, ignore errors.
 	//then get the status of the VM. Wait either we'll get a success or we get an error
 	//after that, nuke it. we can't do much else
+	//the key is useless from here on, so forget it no matter how the delete goes
+	defer discardVMKey(id)
+
+	logger.Info("Deleting VM", "vmid", id)
 	u, err := url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/status/stop", ProxmoxUrl, ProxmoxNode, id))
 	if err != nil {
-		proxmoxLogger.Printf("Failed to delete VM: %s", err.Error())
+		logger.Error("Failed to delete VM", "vmid", id, "error", err)
 		return
 	}
-	_, err = doRequest[None](http.MethodPost, u, nil)
+	_, err = doRequest[None](ctx, http.MethodPost, u, nil)
 
 	timeout := time.Now().Add(time.Minute)
 	var status VMStatus
 	u, err = url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d/status/current", ProxmoxUrl, ProxmoxNode, id))
 	for err == nil && status.Status != "stopped" && time.Now().Before(timeout) {
-		status, err = doRequest[VMStatus](http.MethodGet, u, nil)
+		status, err = doRequest[VMStatus](ctx, http.MethodGet, u, nil)
 	}
 	if err != nil {
-		proxmoxLogger.Printf("Failed to query VM status: %s", err.Error())
+		logger.Warn("Failed to query VM status", "vmid", id, "error", err)
 	}
 
 	//now... nuke it
 	u, err = url.Parse(fmt.Sprintf("%s/api2/json/nodes/%s/qemu/%d", ProxmoxUrl, ProxmoxNode, id))
-	_, err = doRequest[None](http.MethodDelete, u, nil)
+	_, err = doRequest[None](ctx, http.MethodDelete, u, nil)
 	if err != nil {
-		proxmoxLogger.Printf("Failed to delete VM: %s", err.Error())
+		logger.Error("Failed to delete VM", "vmid", id, "error", err)
 	}
 }
 
@@ -498,13 +717,16 @@ type TaskStatus struct {
 type VM struct {
 	Id              int    `json:"vmid,omitempty"`
 	Name            string `json:"name,omitempty"`
+	Status          string `json:"status,omitempty"`
 	CloudInitCustom string `json:"cicustom,omitempty"`
 	CloudInitUser   string `json:"ciuser,omitempty"`
 	SshKeys         string `json:"sshkeys,omitempty"`
 }
 
 type VMConfig struct {
-	Net string `json:"net0"`
+	Name     string `json:"name"`
+	Net      string `json:"net0"`
+	Template int    `json:"template"`
 }
 
 type QemuGuestNetwork struct {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JobVersion is the version of QueuedJob this build writes. Bump it when a change means older
+// workers can't make sense of a job anymore, new fields alone don't need it.
+const JobVersion = 1
+
+var ErrJobVersion = errors.New("job is from a newer version")
+
+// QueuedJob is what goes on the queues. The delivery id comes from the webhook that queued the job,
+// and follows it through to the runner so everything one job does can be tied back together.
+type QueuedJob struct {
+	Version  int      `json:"v"`
+	RunId    string   `json:"runId"`
+	JobId    int64    `json:"jobId,omitempty"`
+	JobName  string   `json:"jobName,omitempty"`
+	Workflow string   `json:"workflow,omitempty"`
+	Repo     string   `json:"repo,omitempty"`
+	Labels   []string `json:"labels,omitempty"`
+	//HeadSha is the commit the run is for, where provisioning failures get reported.
+	//StatusReported is if one has been, so it can be cleared when a runner starts.
+	HeadSha        string `json:"headSha,omitempty"`
+	StatusReported bool   `json:"statusReported,omitempty"`
+	//RunnerName and Conclusion are who ran the job and how it went, for jobs which have been picked up
+	RunnerName string `json:"runnerName,omitempty"`
+	Conclusion string `json:"conclusion,omitempty"`
+	//Org is the org the webhook came from, whose config the job uses wherever its runner is registered
+	Org string `json:"org,omitempty"`
+	//Scope and Target are where the runner is registered, i.e. org and the org's name
+	Scope      string    `json:"scope,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	DeliveryId string    `json:"deliveryId,omitempty"`
+	Queued     time.Time `json:"queued"`
+	//Attempt is how many times a worker has taken the job off the queue
+	Attempt int `json:"attempt"`
+	//LastError is why the last attempt failed, DeadLettered when the job ran out of attempts
+	LastError    string    `json:"lastError,omitempty"`
+	DeadLettered time.Time `json:"deadLettered,omitempty"`
+	//TraceContext carries the span the job was queued under, so tracing picks up where the webhook left off
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// NewQueuedJob is a job for the run, queued now
+func NewQueuedJob(githubRunId string, delivery string) QueuedJob {
+	return QueuedJob{
+		Version:    JobVersion,
+		RunId:      githubRunId,
+		DeliveryId: delivery,
+		Queued:     time.Now(),
+	}
+}
+
+func (j QueuedJob) encode() string {
+	data, _ := json.Marshal(j)
+	return string(data)
+}
+
+// logAttrs are the fields every log line about this job carries
+func (j QueuedJob) logAttrs() []any {
+	attrs := []any{"delivery", j.DeliveryId, "run_id", j.RunId}
+	if j.JobId != 0 {
+		attrs = append(attrs, "job_id", j.JobId)
+	}
+	if j.Repo != "" {
+		attrs = append(attrs, "repo", j.Repo)
+	}
+	if j.Workflow != "" {
+		attrs = append(attrs, "workflow", j.Workflow)
+	}
+	if j.Scope != "" {
+		attrs = append(attrs, "scope", j.Scope, "target", j.Target)
+	}
+	if j.Attempt > 0 {
+		attrs = append(attrs, "attempt", j.Attempt)
+	}
+	return attrs
+}
+
+// decodeJob reads a queue entry. Older versions queued just the run id, those still work.
+// Jobs from a newer version than this one are an error, this worker can't be sure what they mean.
+func decodeJob(value string) (QueuedJob, error) {
+	if !strings.HasPrefix(value, "{") {
+		return QueuedJob{RunId: value}, nil
+	}
+
+	var job QueuedJob
+	if err := json.Unmarshal([]byte(value), &job); err != nil {
+		return job, err
+	}
+	if job.Version > JobVersion {
+		return job, fmt.Errorf("%w: version %d, we only understand up to %d", ErrJobVersion, job.Version, JobVersion)
+	}
+	if job.RunId == "" {
+		return job, errors.New("job has no run id")
+	}
+	return job, nil
+}
+
+// isCorrupt is if decodeJob failed because there's no making sense of the entry. Only those are dropped,
+// jobs from a newer version are left for an instance which can read them.
+func isCorrupt(err error) bool {
+	return err != nil && !errors.Is(err, ErrJobVersion)
+}
+
+// newDeliveryId makes up a correlation id for jobs that didn't come from a webhook
+func newDeliveryId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// listQueuedJobs returns everything waiting in the queue, oldest first
+func listQueuedJobs(queue string) ([]QueuedJob, error) {
+	values, err := rdb.LRange(context.Background(), queue, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]QueuedJob, 0, len(values))
+	for _, v := range values {
+		//anything we can't read is still shown, as far as we can make it out
+		job, _ := decodeJob(v)
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// removeQueuedJob drops every entry for the run from the queue, returning how many there were
+func removeQueuedJob(queue string, runId string) (int64, error) {
+	values, err := rdb.LRange(context.Background(), queue, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, v := range values {
+		if job, _ := decodeJob(v); job.RunId != runId {
+			continue
+		}
+		count, err := rdb.LRem(context.Background(), queue, 1, v).Result()
+		if err != nil {
+			return removed, err
+		}
+		removed += count
+	}
+	return removed, nil
+}
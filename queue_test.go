@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDecodeJobCorrupt(t *testing.T) {
+	current := NewQueuedJob("123", "delivery")
+	newer := NewQueuedJob("456", "delivery")
+	newer.Version = JobVersion + 1
+
+	tests := []struct {
+		name    string
+		value   string
+		err     bool
+		corrupt bool
+	}{
+		{name: "bare run id", value: "123"},
+		{name: "current version", value: current.encode()},
+		{name: "newer version", value: newer.encode(), err: true},
+		{name: "bad json", value: `{"runId":`, err: true, corrupt: true},
+		{name: "no run id", value: `{"v":` + strconv.Itoa(JobVersion) + `}`, err: true, corrupt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeJob(tt.value)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if isCorrupt(err) != tt.corrupt {
+				t.Errorf("expected corrupt %v, got %v (%v)", tt.corrupt, isCorrupt(err), err)
+			}
+		})
+	}
+}
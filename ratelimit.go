@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitsKey holds the latest GitHub rate limit each instance has seen, by instance, client then resource
+const RateLimitsKey = "github_rate_limits"
+
+// GithubRateLimitReserve is how many calls are held back once the limit is nearly used up.
+// Calls wait for the limit to reset instead, so a burst of jobs can't use the last of it.
+var GithubRateLimitReserve = env.GetIntOr("github.ratelimit.reserve", 50)
+
+// GithubRateLimitRetries is how many times a call hitting a secondary rate limit is tried again
+var GithubRateLimitRetries = env.GetIntOr("github.ratelimit.retries", 3)
+
+// GithubRateLimitMaxWait is the longest a call waits on the limit. Anything which would need longer,
+// or would wait past its context's deadline, fails with ErrRateLimited so the job can be put back.
+var GithubRateLimitMaxWait = time.Duration(env.GetIntOr("github.ratelimit.maxwait", 60)) * time.Second
+
+var ErrRateLimited = errors.New("waiting on the GitHub rate limit")
+
+// GitHub asks for at least a minute when a secondary limit doesn't say how long
+const secondaryRateLimitWait = time.Minute
+
+var rateLimitLogger = newLogger("ratelimit")
+
+// RateLimit is where a client is at with one of GitHub's rate limits
+type RateLimit struct {
+	Instance  string    `json:"instance"`
+	Client    string    `json:"client"`
+	Resource  string    `json:"resource"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	//BlockedUntil is when a secondary limit we hit is over
+	BlockedUntil time.Time `json:"blockedUntil,omitempty"`
+	//Throttled is how many calls this instance has had to hold back for the limit
+	Throttled int64     `json:"throttled"`
+	Updated   time.Time `json:"updated"`
+}
+
+// rateLimitTransport sits under the cache, so only calls which actually go to GitHub count.
+// It holds calls back when the limit is nearly gone, and retries them after a secondary limit.
+type rateLimitTransport struct {
+	client string
+	next   http.RoundTripper
+
+	lock         sync.Mutex
+	limits       map[string]*RateLimit
+	blockedUntil time.Time
+	throttled    int64
+}
+
+func newRateLimitTransport(client string, next http.RoundTripper) *rateLimitTransport {
+	return &rateLimitTransport{
+		client: client,
+		next:   next,
+		limits: make(map[string]*RateLimit),
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(request.Context()); err != nil {
+			return nil, err
+		}
+
+		response, err := t.next.RoundTrip(request)
+		if err != nil {
+			return response, err
+		}
+		t.update(response)
+
+		delay, limited := secondaryRateLimit(response)
+		if !limited {
+			return response, nil
+		}
+		t.block(delay)
+		rateLimitLogger.Warn("Hit GitHub rate limit", "client", t.client, "url", request.URL.Path, "retry_after", delay, "attempt", attempt+1)
+
+		//the body has to be sent again, so only requests which can do that get retried
+		if attempt >= GithubRateLimitRetries || (request.Body != nil && request.GetBody == nil) {
+			return response, nil
+		}
+		CloseResponse(response)
+		request = request.Clone(request.Context())
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// blockedFor is how long before it's safe to make a call, going by what we've seen of the limit
+func (t *rateLimitTransport) blockedFor() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	until := t.blockedUntil
+	if core := t.limits["core"]; core != nil && core.Remaining <= GithubRateLimitReserve && core.Reset.After(until) {
+		until = core.Reset
+	}
+	return time.Until(until)
+}
+
+// wait holds the call until it's safe to make
+func (t *rateLimitTransport) wait(ctx context.Context) error {
+	delay := t.blockedFor()
+	if delay <= 0 {
+		return nil
+	}
+	t.lock.Lock()
+	t.throttled++
+	t.lock.Unlock()
+	t.save()
+
+	limit := GithubRateLimitMaxWait
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < limit {
+		limit = time.Until(deadline)
+	}
+	if delay > limit {
+		return fmt.Errorf("%w, %s needs %s", ErrRateLimited, t.client, delay.Round(time.Second))
+	}
+
+	rateLimitLogger.Warn("Waiting for GitHub rate limit", "client", t.client, "delay", delay)
+	sleep(ctx, delay)
+	return ctx.Err()
+}
+
+func (t *rateLimitTransport) block(delay time.Duration) {
+	t.lock.Lock()
+	if until := time.Now().Add(delay); until.After(t.blockedUntil) {
+		t.blockedUntil = until
+	}
+	t.lock.Unlock()
+	t.save()
+}
+
+// update records the limit from the response headers
+func (t *rateLimitTransport) update(response *http.Response) {
+	limit, err := strconv.Atoi(response.Header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, _ := strconv.Atoi(response.Header.Get("X-RateLimit-Remaining"))
+	reset, _ := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64)
+	resource := response.Header.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = "core"
+	}
+
+	t.lock.Lock()
+	t.limits[resource] = &RateLimit{
+		Client:    t.client,
+		Resource:  resource,
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	t.lock.Unlock()
+	t.save()
+}
+
+// save shares where we're at, so the web instances can report on what the workers are using
+func (t *rateLimitTransport) save() {
+	t.lock.Lock()
+	values := make(map[string]any, len(t.limits))
+	for k, v := range t.limits {
+		limit := *v
+		limit.Instance = InstanceId
+		limit.BlockedUntil = t.blockedUntil
+		limit.Throttled = t.throttled
+		limit.Updated = time.Now()
+		if data, err := json.Marshal(limit); err == nil {
+			values[InstanceId+":"+t.client+":"+k] = data
+		}
+	}
+	t.lock.Unlock()
+
+	if len(values) == 0 {
+		return
+	}
+	if err := rdb.HSet(context.Background(), RateLimitsKey, values).Err(); err != nil {
+		rateLimitLogger.Error("Failed to save rate limit", "client", t.client, "error", err)
+	}
+}
+
+// secondaryRateLimit is if GitHub turned the call away for going too fast, and how long to leave it.
+// Those come back as a 403 or 429, with Retry-After or with the primary limit used up.
+func secondaryRateLimit(response *http.Response) (time.Duration, bool) {
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if response.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, _ := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64)
+		return max(time.Until(time.Unix(reset, 0)), time.Second), true
+	}
+	if response.StatusCode == http.StatusTooManyRequests {
+		return secondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+// getRateLimits returns the latest rate limits seen by each instance. Instances which have gone away are cleaned up.
+func getRateLimits(ctx context.Context) ([]RateLimit, error) {
+	values, err := rdb.HGetAll(ctx, RateLimitsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]RateLimit, 0, len(values))
+	for k, v := range values {
+		var limit RateLimit
+		if err = json.Unmarshal([]byte(v), &limit); err != nil || limit.Instance == "" || !isInstanceAlive(limit.Instance) {
+			rdb.HDel(ctx, RateLimitsKey, k)
+			continue
+		}
+		result = append(result, limit)
+	}
+	return result, nil
+}
+
+// latestRateLimits is the most recent of what each instance has seen, for each client and resource
+func latestRateLimits(limits []RateLimit) []RateLimit {
+	latest := make(map[string]RateLimit)
+	for _, v := range limits {
+		key := v.Client + ":" + v.Resource
+		if existing, exists := latest[key]; !exists || v.Updated.After(existing.Updated) {
+			latest[key] = v
+		}
+	}
+	result := make([]RateLimit, 0, len(latest))
+	for _, v := range latest {
+		result = append(result, v)
+	}
+	return result
+}
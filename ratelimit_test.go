@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	reserve := GithubRateLimitReserve
+	defer func() {
+		GithubRateLimitReserve = reserve
+	}()
+	GithubRateLimitReserve = 50
+
+	limiter := newRateLimitTransport("test", http.DefaultTransport)
+	org := &OrgConfig{Name: "test", limiter: limiter}
+	if delay := org.rateLimitDelay(); delay != 0 {
+		t.Errorf("expected no delay before any calls, got %s", delay)
+	}
+
+	reset := time.Now().Add(time.Hour)
+	limiter.limits["core"] = &RateLimit{Resource: "core", Limit: 5000, Remaining: 1000, Reset: reset}
+	if delay := org.rateLimitDelay(); delay != 0 {
+		t.Errorf("expected no delay with calls to spare, got %s", delay)
+	}
+
+	limiter.limits["core"].Remaining = 10
+	if delay := org.rateLimitDelay(); delay < 59*time.Minute || delay > time.Hour {
+		t.Errorf("expected to wait for the reset, got %s", delay)
+	}
+
+	//a secondary limit lasting longer than the primary one is what counts
+	limiter.blockedUntil = reset.Add(time.Hour)
+	if delay := org.rateLimitDelay(); delay < 119*time.Minute || delay > 2*time.Hour {
+		t.Errorf("expected to wait for the secondary limit, got %s", delay)
+	}
+
+	if delay := (&OrgConfig{Name: "none"}).rateLimitDelay(); delay != 0 {
+		t.Errorf("expected no delay without a limiter, got %s", delay)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var reconcileInterval = 5 * time.Minute
+
+var ErrReconcileRunning = errors.New("reconcile already running")
+
+var reconcileLogger = newLogger("reconciler")
+
+type ReconcileResult struct {
+	DeletedVMs     []int    `json:"deletedVms"`
+	FailedRunners  []string `json:"failedRunners"`
+	PrunedRunners  []string `json:"prunedRunners"`
+	IdleRunners    []string `json:"idleRunners"`
+	ActiveRunners  int      `json:"activeRunners"`
+	RunningVMCount int      `json:"runningVms"`
+}
+
+func StartReconciler() {
+	go func() {
+		for {
+			time.Sleep(reconcileInterval)
+			if _, err := reconcile(); err != nil && !errors.Is(err, ErrReconcileRunning) {
+				reconcileLogger.Error("Failed to reconcile", "error", err)
+			}
+		}
+	}()
+}
+
+// reconcile brings proxmox and our runner records back in line with each other:
+// VMs nobody is driving get deleted, runners whose VM is gone get failed, and old finished runners are forgotten
+func reconcile() (result *ReconcileResult, err error) {
+	ctx, span := tracer.Start(context.Background(), "reconcile")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	//only one instance reconciles at a time, two deleting the same VM gets messy
+	lock, err := tryLock(ReconcileLock, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, ErrReconcileRunning
+	}
+	defer lock.Release()
+
+	vms, err := getVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runners, err := listRunners()
+	if err != nil {
+		return nil, err
+	}
+
+	result = &ReconcileResult{}
+
+	existing := make(map[int]bool)
+	for _, v := range vms {
+		if strings.HasPrefix(v.Name, VmNamePrefix) {
+			existing[v.Id] = true
+		}
+	}
+	result.RunningVMCount = len(existing)
+
+	owned := make(map[int]bool)
+	for _, v := range runners {
+		if !v.IsActive() {
+			if time.Since(v.Updated) > finishedRunnerRetention {
+				if err = deleteRunner(v.Id); err == nil {
+					result.PrunedRunners = append(result.PrunedRunners, v.Id)
+				}
+			}
+			continue
+		}
+
+		//its worker is still waiting on it, but there's nothing for it to do. Deleting the VM gets the worker to
+		//clean the rest up, so it's left out of owned.
+		if !v.IsAbandoned() && (v.IsIdle() || v.IsStuck()) {
+			reconcileLogger.Warn("Runner has nothing to do", "runner", v.Id, "vmid", v.VMID, "state", v.State, "idle", v.IsIdle(), "delivery", v.Delivery)
+			result.IdleRunners = append(result.IdleRunners, v.Id)
+			continue
+		}
+
+		//someone is still working on it, leave it alone
+		if !v.IsAbandoned() {
+			result.ActiveRunners++
+			owned[v.VMID] = true
+			continue
+		}
+
+		//whoever was driving this runner is gone, but the job on it is still going. Deleting the VM would fail
+		//the job, so it's left to finish and cleaned up once the job completes.
+		if v.IsRunningJob() {
+			result.ActiveRunners++
+			owned[v.VMID] = true
+			continue
+		}
+
+		//whoever was driving this runner is gone, nobody will finish it now
+		if v.Assignment != nil && !v.Assignment.Completed.IsZero() {
+			reconcileLogger.Info("Cleaning up after abandoned runner's job completed", "runner", v.Id, "vmid", v.VMID, "delivery", v.Delivery)
+			v.Deregister(ctx, reconcileLogger)
+			v.Finish(nil)
+			continue
+		}
+		reconcileLogger.Warn("Runner was abandoned", "runner", v.Id, "vmid", v.VMID, "state", v.State, "delivery", v.Delivery)
+		v.SetError(errors.New("abandoned in state " + v.State))
+		v.Deregister(ctx, reconcileLogger)
+		v.SetState(StateFailed)
+		result.FailedRunners = append(result.FailedRunners, v.Id)
+	}
+
+	for id := range existing {
+		if owned[id] {
+			continue
+		}
+		reconcileLogger.Info("Deleting orphaned VM", "vmid", id)
+		deleteVM(ctx, id, reconcileLogger)
+		result.DeletedVMs = append(result.DeletedVMs, id)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var RunnerArch = env.GetOr("runner.arch", "linux-x64")
+var RunnerMirrorDir = env.Get("runner.mirror.dir")
+var RunnerCacheDir = env.GetOr("runner.cache.dir", filepath.Join(os.TempDir(), "runner-cache"))
+var RunnerTemplateDir = env.GetOr("runner.template.dir", "/opt/runner-cache")
+
+// how often we go back to the mirror or GitHub to see if there's a new runner out
+var runnerReleaseRefresh = time.Hour
+
+// how long to wait before trying again when the mirror or GitHub couldn't tell us
+var runnerReleaseRetry = 5 * time.Minute
+
+var latestRelease *RunnerRelease
+var latestReleaseErr error
+var latestReleaseChecked time.Time
+var latestReleaseLock sync.Mutex
+
+type RunnerRelease struct {
+	Version string
+	Path    string
+}
+
+// getLatestRunner returns the newest runner we know about, with the tarball cached locally
+func getLatestRunner() (*RunnerRelease, error) {
+	latestReleaseLock.Lock()
+	defer latestReleaseLock.Unlock()
+
+	if time.Since(latestReleaseChecked) < runnerReleaseRefresh {
+		if latestRelease != nil {
+			return latestRelease, nil
+		}
+		return nil, latestReleaseErr
+	}
+
+	var release *RunnerRelease
+	var err error
+	if RunnerMirrorDir != "" {
+		release, err = getMirrorRunner()
+	} else {
+		release, err = downloadLatestRunner()
+	}
+	if err != nil {
+		//don't have every job go back and ask while it's down, try again a bit sooner than usual
+		latestReleaseErr = err
+		latestReleaseChecked = time.Now().Add(runnerReleaseRetry - runnerReleaseRefresh)
+
+		//if we had one before, keep using it rather than failing the job
+		if latestRelease != nil {
+			return latestRelease, err
+		}
+		return nil, err
+	}
+
+	latestRelease = release
+	latestReleaseErr = nil
+	latestReleaseChecked = time.Now()
+	return latestRelease, nil
+}
+
+// getMirrorRunner finds the newest tarball for our arch in the local mirror directory
+func getMirrorRunner() (*RunnerRelease, error) {
+	matches, err := filepath.Glob(filepath.Join(RunnerMirrorDir, runnerFileName("*")))
+	if err != nil {
+		return nil, err
+	}
+
+	var release *RunnerRelease
+	for _, v := range matches {
+		version := parseRunnerVersion(filepath.Base(v))
+		if release == nil || compareVersions(version, release.Version) > 0 {
+			release = &RunnerRelease{Version: version, Path: v}
+		}
+	}
+	if release == nil {
+		return nil, fmt.Errorf("no runner found in %s", RunnerMirrorDir)
+	}
+	return release, nil
+}
+
+// downloadLatestRunner asks GitHub for the latest actions/runner release and caches the tarball
+func downloadLatestRunner() (*RunnerRelease, error) {
+	release, response, err := githubClient.Repositories.GetLatestRelease(context.Background(), "actions", "runner")
+	defer CloseGithubResponse(response)
+	if err != nil {
+		return nil, err
+	}
+
+	version := strings.TrimPrefix(release.GetTagName(), "v")
+	name := runnerFileName(version)
+	target := filepath.Join(RunnerCacheDir, name)
+
+	if _, err = os.Stat(target); err == nil {
+		return &RunnerRelease{Version: version, Path: target}, nil
+	}
+
+	var downloadUrl string
+	for _, v := range release.Assets {
+		if v.GetName() == name {
+			downloadUrl = v.GetBrowserDownloadURL()
+			break
+		}
+	}
+	if downloadUrl == "" {
+		return nil, fmt.Errorf("release %s has no asset %s", version, name)
+	}
+
+	err = os.MkdirAll(RunnerCacheDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Get(downloadUrl)
+	defer CloseResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s (%d)", downloadUrl, res.StatusCode)
+	}
+
+	//write to a temp file first, so a failed download doesn't look like a cached one
+	file, err := os.CreateTemp(RunnerCacheDir, name+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = io.Copy(file, res.Body)
+	Close(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(file.Name(), target)
+	if err != nil {
+		return nil, err
+	}
+	return &RunnerRelease{Version: version, Path: target}, nil
+}
+
+// prepareRunner extracts the runner into the home directory, replacing the template's copy when it's too old
+func prepareRunner(client *ssh.Client, logger *slog.Logger) error {
+	templateVersion, templateFile, err := getTemplateRunnerVersion(client)
+	if err != nil {
+		logger.Warn("Failed to determine template runner version", "error", err)
+	}
+
+	latest, err := getLatestRunner()
+	if err != nil {
+		logger.Warn("Failed to determine latest runner version", "error", err)
+	}
+
+	if latest == nil || (templateVersion != "" && compareVersions(templateVersion, latest.Version) >= 0) {
+		if templateVersion == "" {
+			return errors.New("no runner available in template or cache")
+		}
+		logger.Info("Extracting runner from template", "version", templateVersion)
+		return executeCommand(client, fmt.Sprintf("tar -xzf %s -C .", path.Join(RunnerTemplateDir, templateFile)), logger)
+	}
+
+	if templateVersion == "" {
+		logger.Info("Template has no runner, uploading", "version", latest.Version)
+	} else {
+		logger.Warn("Runner version skew, uploading", "template_version", templateVersion, "version", latest.Version)
+	}
+
+	target := filepath.Base(latest.Path)
+	if err = uploadFile(client, latest.Path, target); err != nil {
+		return err
+	}
+	return executeCommand(client, fmt.Sprintf("tar -xzf %s -C . && rm -f %s", target, target), logger)
+}
+
+// getTemplateRunnerVersion looks at which runner tarballs for our arch the template VM has baked in, and returns the newest
+func getTemplateRunnerVersion(client *ssh.Client) (version string, filename string, err error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return
+	}
+	defer Close(session)
+
+	data, err := session.Output(fmt.Sprintf("ls -1 %s", RunnerTemplateDir))
+	if err != nil {
+		return
+	}
+
+	for _, v := range strings.Split(string(data), "\n") {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "actions-runner-"+RunnerArch+"-") || !strings.HasSuffix(v, ".tar.gz") {
+			continue
+		}
+		if z := parseRunnerVersion(v); version == "" || compareVersions(z, version) > 0 {
+			version = z
+			filename = v
+		}
+	}
+	return
+}
+
+func runnerFileName(version string) string {
+	return fmt.Sprintf("actions-runner-%s-%s.tar.gz", RunnerArch, version)
+}
+
+// parseRunnerVersion pulls the version out of names like actions-runner-linux-x64-2.325.0.tar.gz
+func parseRunnerVersion(filename string) string {
+	name := strings.TrimSuffix(filename, ".tar.gz")
+	return name[strings.LastIndex(name, "-")+1:]
+}
+
+// compareVersions compares dotted versions numerically, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	x := strings.Split(a, ".")
+	y := strings.Split(b, ".")
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var l, r int
+		if i < len(x) {
+			l, _ = strconv.Atoi(x[i])
+		}
+		if i < len(y) {
+			r, _ = strconv.Atoi(y[i])
+		}
+		if l < r {
+			return -1
+		}
+		if l > r {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-github/v73/github"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// statusContext is what our commit statuses are called, one per job so a matrix doesn't overwrite itself
+const statusContext = "runner-scaler"
+
+// GitHub cuts commit status descriptions off past this
+const statusDescriptionLimit = 140
+
+// reportProvisioningFailure lets whoever is watching the run know why there's no runner yet,
+// marking the job so the status gets cleared once it does get one.
+// Returns true if the run was cancelled, so there's no point trying again.
+func reportProvisioningFailure(job *QueuedJob, cause error, final bool, logger *slog.Logger) bool {
+	org := job.org()
+	ctx := context.Background()
+
+	if org.CancelAfter > 0 && job.Attempt >= org.CancelAfter {
+		err := cancelWorkflowRun(ctx, org, *job)
+		if err == nil {
+			logger.Warn("Cancelled workflow run after failing to provision", "attempts", job.Attempt)
+			setJobStatus(ctx, org, *job, "failure", "runner provisioning failed, run cancelled: "+cause.Error(), logger)
+			return true
+		}
+		logger.Error("Failed to cancel workflow run", "error", err)
+	}
+
+	state, description := "pending", fmt.Sprintf("runner provisioning failed, retrying (attempt %d): %s", job.Attempt, cause.Error())
+	if final {
+		state, description = "error", "runner provisioning failed: "+cause.Error()
+	}
+	if setJobStatus(ctx, org, *job, state, description, logger) {
+		job.StatusReported = true
+	}
+	return false
+}
+
+// reportRunnerStarted clears out any failure reported for an earlier attempt
+func reportRunnerStarted(ctx context.Context, job QueuedJob, logger *slog.Logger) {
+	if !job.StatusReported {
+		return
+	}
+	setJobStatus(ctx, job.org(), job, "success", fmt.Sprintf("runner started (attempt %d)", job.Attempt), logger)
+}
+
+// setJobStatus sets a commit status on the commit the job is running for, if the org wants them.
+// Returns if the status was set.
+func setJobStatus(ctx context.Context, org *OrgConfig, job QueuedJob, state string, description string, logger *slog.Logger) bool {
+	if !org.Status || job.HeadSha == "" {
+		return false
+	}
+	owner, repo, found := strings.Cut(job.Repo, "/")
+	if !found {
+		return false
+	}
+
+	if utf8.RuneCountInString(description) > statusDescriptionLimit {
+		description = string([]rune(description)[:statusDescriptionLimit-3]) + "..."
+	}
+	name := statusContext
+	if job.JobName != "" {
+		name += " / " + job.JobName
+	}
+
+	_, response, err := org.Client.Repositories.CreateStatus(ctx, owner, repo, job.HeadSha, &github.RepoStatus{
+		State:       github.Ptr(state),
+		Description: github.Ptr(description),
+		Context:     github.Ptr(name),
+	})
+	CloseGithubResponse(response)
+	if err != nil {
+		logger.Error("Failed to set commit status", "state", state, "error", err)
+		return false
+	}
+	return true
+}
+
+func cancelWorkflowRun(ctx context.Context, org *OrgConfig, job QueuedJob) error {
+	owner, repo, found := strings.Cut(job.Repo, "/")
+	if !found {
+		return fmt.Errorf("unknown repo %q", job.Repo)
+	}
+	runId, err := strconv.ParseInt(job.RunId, 10, 64)
+	if err != nil {
+		return err
+	}
+	response, err := org.Client.Actions.CancelWorkflowRunByID(ctx, owner, repo, runId)
+	CloseGithubResponse(response)
+	//GitHub accepts the cancel and then does it later, which comes back as an error
+	if _, accepted := err.(*github.AcceptedError); accepted {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var LogRetentionDays = env.GetIntOr("log.retention.days", 30)
+var LogRetentionSize = int64(env.GetInt("log.retention.size")) * 1024 * 1024
+var LogCompress = env.GetBoolOr("log.compress", true)
+
+// logs which were never finished off (i.e. we crashed) get picked up once they've been quiet this long
+var abandonedLogAge = time.Hour
+
+var retentionLogger = newLogger("logs")
+
+func StartLogRetention() {
+	go func() {
+		for {
+			sweepLogs()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// finishLog compresses and exports a log once nothing is writing to it anymore
+func finishLog(id string) {
+	path := logPath(id)
+	if LogCompress {
+		compressed, err := compressLog(path)
+		if err != nil {
+			retentionLogger.Error("Failed to compress log", "path", path, "error", err)
+		} else {
+			path = compressed
+		}
+	}
+
+	if LogExportEnabled {
+		if err := exportLog(path); err != nil {
+			retentionLogger.Error("Failed to export log", "path", path, "error", err)
+		}
+	}
+}
+
+// compressLog gzips the file next to itself and removes the original
+func compressLog(path string) (string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer Close(source)
+
+	target := path + ".gz"
+	file, err := os.Create(target)
+	if err != nil {
+		return "", err
+	}
+
+	writer := gzip.NewWriter(file)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	Close(file)
+	if err != nil {
+		_ = os.Remove(target)
+		return "", err
+	}
+
+	//keep the original timestamp, that's what retention goes off
+	if stat, err := source.Stat(); err == nil {
+		_ = os.Chtimes(target, stat.ModTime(), stat.ModTime())
+	}
+
+	Close(source)
+	return target, os.Remove(path)
+}
+
+// sweepLogs finishes off abandoned logs, then removes the ones past the max age or over the size limit
+func sweepLogs() {
+	//every worker shares the log directory, only one needs to sweep it
+	lock, err := tryLock(RetentionLock, 10*time.Minute)
+	if err != nil || lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	files, err := listLogFiles()
+	if err != nil {
+		retentionLogger.Error("Failed to list logs", "error", err)
+		return
+	}
+
+	var kept []logFile
+	var total int64
+	for _, v := range files {
+		if v.Active {
+			total += v.Size
+			continue
+		}
+
+		if LogRetentionDays > 0 && time.Since(v.Modified) > time.Duration(LogRetentionDays)*24*time.Hour {
+			removeLog(v)
+			continue
+		}
+
+		if !v.Compressed && time.Since(v.Modified) > abandonedLogAge {
+			finishLog(v.Id)
+			if stat, err := os.Stat(v.Path + ".gz"); err == nil {
+				v.Path = v.Path + ".gz"
+				v.Size = stat.Size()
+				v.Compressed = true
+			}
+		}
+
+		total += v.Size
+		kept = append(kept, v)
+	}
+
+	if LogRetentionSize <= 0 {
+		return
+	}
+
+	//oldest go first
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Modified.Before(kept[j].Modified)
+	})
+	for i := 0; i < len(kept) && total > LogRetentionSize; i++ {
+		removeLog(kept[i])
+		total -= kept[i].Size
+	}
+}
+
+func removeLog(file logFile) {
+	retentionLogger.Info("Removing log", "path", file.Path)
+	if err := os.Remove(file.Path); err != nil {
+		retentionLogger.Error("Failed to remove log", "path", file.Path, "error", err)
+	}
+}
+
+type logFile struct {
+	LogInfo
+	Path string
+}
+
+// listLogFiles finds every log, plain or compressed
+func listLogFiles() ([]logFile, error) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	active := activeRunnerIds()
+
+	var result []logFile
+	for _, v := range entries {
+		var id string
+		var compressed bool
+		if strings.HasSuffix(v.Name(), ".log.gz") {
+			id = strings.TrimSuffix(v.Name(), ".log.gz")
+			compressed = true
+		} else if strings.HasSuffix(v.Name(), ".log") {
+			id = strings.TrimSuffix(v.Name(), ".log")
+		} else {
+			continue
+		}
+
+		stat, err := v.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, logFile{
+			LogInfo: LogInfo{
+				Id:         id,
+				Size:       stat.Size(),
+				Modified:   stat.ModTime(),
+				Active:     active[id],
+				Compressed: compressed,
+			},
+			Path: filepath.Join(logDir, v.Name()),
+		})
+	}
+	return result, nil
+}
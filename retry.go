@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// RetryQueueName holds jobs waiting out their backoff, scored by when they can go back on the queue
+const RetryQueueName = "workflow_retry_queue"
+
+// DeadLetterQueueName holds jobs which ran out of attempts, along with why
+const DeadLetterQueueName = "workflow_dead_letters"
+
+// RetryAttempts is how many times a job is tried in total before it's dead lettered
+var RetryAttempts = env.GetIntOr("retry.attempts", 3)
+
+// RetryBackoff is how long before the first retry, it doubles for each one after up to RetryBackoffMax
+var RetryBackoff = time.Duration(env.GetIntOr("retry.backoff", 30)) * time.Second
+var RetryBackoffMax = time.Duration(env.GetIntOr("retry.backoff.max", 600)) * time.Second
+
+var retryPollInterval = 5 * time.Second
+
+var ErrNotDeadLettered = errors.New("job is not dead lettered")
+var ErrJobNotFound = errors.New("no record of the job")
+var ErrJobHasRunner = errors.New("job already has a runner")
+
+// retryJob puts the job back on the queue after a backoff, or dead letters it if it's out of attempts.
+// Either way GitHub is told, if the org wants, and if that cancelled the run there's nothing left to do.
+func retryJob(job QueuedJob, cause error, logger *slog.Logger) {
+	job.LastError = cause.Error()
+
+	if reportProvisioningFailure(&job, cause, job.Attempt >= RetryAttempts, logger) {
+		return
+	}
+
+	if job.Attempt >= RetryAttempts {
+		logger.Error("Job is out of attempts, dead lettering", "attempts", job.Attempt, "error", cause)
+		job.DeadLettered = time.Now()
+		if err := rdb.RPush(context.Background(), DeadLetterQueueName, job.encode()).Err(); err != nil {
+			logger.Error("Failed to dead letter job", "error", err)
+		}
+		return
+	}
+
+	delay := retryDelay(job.Attempt)
+	logger.Warn("Retrying job", "attempts", job.Attempt, "delay", delay, "error", cause)
+	err := rdb.ZAdd(context.Background(), RetryQueueName, redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: job.encode(),
+	}).Err()
+	if err != nil {
+		logger.Error("Failed to schedule retry", "error", err)
+	}
+}
+
+// delayJob puts the job back on the queue after the delay, without it counting as a failed attempt.
+// This is for when it's us that can't go on, i.e. we're waiting on the GitHub rate limit.
+func delayJob(job QueuedJob, delay time.Duration, logger *slog.Logger) {
+	job.Attempt = max(job.Attempt-1, 0)
+	logger.Info("Delaying job", "delay", delay)
+	err := rdb.ZAdd(context.Background(), RetryQueueName, redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: job.encode(),
+	}).Err()
+	if err != nil {
+		logger.Error("Failed to delay job", "error", err)
+	}
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := RetryBackoff
+	for i := 1; i < attempt && delay < RetryBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, RetryBackoffMax)
+}
+
+// retryWorker moves jobs whose backoff is up back onto the queue
+func retryWorker(ctx context.Context) {
+	defer workers.Done()
+
+	logger := newLogger("retry")
+	for ctx.Err() == nil {
+		due, err := rdb.ZRangeByScoreWithScores(context.Background(), RetryQueueName, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().Unix(), 10),
+		}).Result()
+		if err != nil {
+			logger.Error("Failed to read retry queue", "error", err)
+		}
+
+		for _, v := range due {
+			//whoever removes it gets to queue it, so two instances don't both do it
+			removed, err := rdb.ZRem(context.Background(), RetryQueueName, v.Member).Result()
+			if err != nil || removed == 0 {
+				continue
+			}
+			job, err := decodeJob(v.Member.(string))
+			if isCorrupt(err) {
+				logger.Error("Dropping retry we can't read", "job", v.Member, "error", err)
+				continue
+			}
+			if err == nil {
+				err = enqueueJob(context.Background(), job)
+			}
+			if err != nil {
+				//put it back as it was, for us to try again or an instance which can read it
+				logger.Warn("Failed to requeue job", append(job.logAttrs(), "error", err)...)
+				rdb.ZAdd(context.Background(), RetryQueueName, v)
+				continue
+			}
+			logger.Info("Requeued job for retry", job.logAttrs()...)
+		}
+
+		sleep(ctx, retryPollInterval)
+	}
+}
+
+// listRetryingJobs returns the jobs waiting out their backoff
+func listRetryingJobs() ([]QueuedJob, error) {
+	values, err := rdb.ZRange(context.Background(), RetryQueueName, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]QueuedJob, 0, len(values))
+	for _, v := range values {
+		job, _ := decodeJob(v)
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// requeueRun puts a job we already know about back on the queue. That's a dead letter with a fresh set of
+// attempts, a retry without waiting out its backoff, or the job a finished runner was made for.
+func requeueRun(runId string) (*QueuedJob, error) {
+	job, err := replayDeadLetter(runId)
+	if !errors.Is(err, ErrNotDeadLettered) {
+		return job, err
+	}
+
+	values, err := rdb.ZRange(context.Background(), RetryQueueName, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		job, err := decodeJob(v)
+		if err != nil || job.RunId != runId {
+			continue
+		}
+		removed, err := rdb.ZRem(context.Background(), RetryQueueName, v).Result()
+		if err != nil {
+			return nil, err
+		}
+		if removed == 0 {
+			//the retry worker got to it first
+			continue
+		}
+		if err = enqueueJob(context.Background(), job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	}
+
+	runners, err := listRunners()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range runners {
+		if v.RunId != runId {
+			continue
+		}
+		if v.IsActive() {
+			return nil, ErrJobHasRunner
+		}
+		job := v.job()
+		if err = enqueueJob(context.Background(), job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	}
+	return nil, ErrJobNotFound
+}
+
+// replayDeadLetter puts a dead lettered job back on the queue with a fresh set of attempts
+func replayDeadLetter(runId string) (*QueuedJob, error) {
+	values, err := rdb.LRange(context.Background(), DeadLetterQueueName, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		job, err := decodeJob(v)
+		if err != nil || job.RunId != runId {
+			continue
+		}
+
+		removed, err := rdb.LRem(context.Background(), DeadLetterQueueName, 1, v).Result()
+		if err != nil {
+			return nil, err
+		}
+		if removed == 0 {
+			//someone else got to it first
+			continue
+		}
+
+		job.Attempt = 0
+		job.DeadLettered = time.Time{}
+		if err = enqueueJob(context.Background(), job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	}
+	return nil, ErrNotDeadLettered
+}
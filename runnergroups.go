@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-github/v73/github"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"strings"
+	"sync"
+)
+
+// GithubGroupCreate creates the runner group when it doesn't exist, set up with the settings below
+var GithubGroupCreate = env.GetBool("github.group.create")
+
+// GithubGroupVisibility is who can use a created group: all, selected or private (orgs only)
+var GithubGroupVisibility = env.GetOr("github.group.visibility", "all")
+
+// GithubGroupRepos are the repos in an org which can use a created group when it's selected, GithubGroupOrgs the orgs in an enterprise
+var GithubGroupRepos = splitList(env.Get("github.group.repos"))
+var GithubGroupOrgs = splitList(env.Get("github.group.orgs"))
+
+// GithubGroupPublic lets public repos use a created group
+var GithubGroupPublic = env.GetBool("github.group.public")
+
+// GithubGroupWorkflows restricts a created group to these workflows, i.e. myorg/myrepo/.github/workflows/ci.yml@refs/heads/main
+var GithubGroupWorkflows = splitList(env.Get("github.group.workflows"))
+
+var ErrRunnerGroupNotFound = errors.New("runner group not found")
+
+// runner group ids don't change, so they're only looked up once unless using them fails
+var runnerGroupIds = make(map[string]int64)
+var runnerGroupIdsLock sync.Mutex
+
+func runnerGroupKey(scope string, target string, group string) string {
+	return strings.ToLower(scope + ":" + target + ":" + group)
+}
+
+func GetRunnerGroupId(ctx context.Context, org *OrgConfig, scope string, target string) (int64, error) {
+	if scope == ScopeRepo {
+		return defaultRunnerGroupId, nil
+	}
+
+	key := runnerGroupKey(scope, target, org.Group)
+
+	runnerGroupIdsLock.Lock()
+	id, exists := runnerGroupIds[key]
+	runnerGroupIdsLock.Unlock()
+	if exists {
+		return id, nil
+	}
+
+	//looked up without the lock, so one slow or rate limited org doesn't hold up the rest.
+	//Two workers may both look the same group up, they'll get the same id.
+	id, err := findRunnerGroup(ctx, org.Client, scope, target, org.Group)
+	if errors.Is(err, ErrRunnerGroupNotFound) && GithubGroupCreate {
+		id, err = createRunnerGroup(ctx, org.Client, scope, target, org.Group)
+		if err != nil {
+			//another instance may have beaten us to it
+			if found, findErr := findRunnerGroup(ctx, org.Client, scope, target, org.Group); findErr == nil {
+				id, err = found, nil
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	runnerGroupIdsLock.Lock()
+	runnerGroupIds[key] = id
+	runnerGroupIdsLock.Unlock()
+	return id, nil
+}
+
+// forgetRunnerGroupId drops the cached id, so it's looked up again in case the group was deleted or recreated
+func forgetRunnerGroupId(org *OrgConfig, scope string, target string) {
+	runnerGroupIdsLock.Lock()
+	defer runnerGroupIdsLock.Unlock()
+	delete(runnerGroupIds, runnerGroupKey(scope, target, org.Group))
+}
+
+// findRunnerGroup goes through every page of runner groups looking for the one with the name
+func findRunnerGroup(ctx context.Context, client *github.Client, scope string, target string, name string) (int64, error) {
+	options := github.ListOptions{PerPage: 100}
+	for {
+		var groups []*github.RunnerGroup
+		var response *github.Response
+		var err error
+		if scope == ScopeEnterprise {
+			var result *github.EnterpriseRunnerGroups
+			result, response, err = client.Enterprise.ListRunnerGroups(ctx, target, &github.ListEnterpriseRunnerGroupOptions{ListOptions: options})
+			if result != nil {
+				for _, v := range result.RunnerGroups {
+					groups = append(groups, &github.RunnerGroup{ID: v.ID, Name: v.Name})
+				}
+			}
+		} else {
+			var result *github.RunnerGroups
+			result, response, err = client.Actions.ListOrganizationRunnerGroups(ctx, target, &github.ListOrgRunnerGroupOptions{ListOptions: options})
+			if result != nil {
+				groups = result.RunnerGroups
+			}
+		}
+		CloseGithubResponse(response)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, g := range groups {
+			if g.GetName() == name {
+				return g.GetID(), nil
+			}
+		}
+
+		if response.NextPage == 0 {
+			return 0, ErrRunnerGroupNotFound
+		}
+		options.Page = response.NextPage
+	}
+}
+
+func createRunnerGroup(ctx context.Context, client *github.Client, scope string, target string, name string) (int64, error) {
+	restricted := len(GithubGroupWorkflows) > 0
+
+	if scope == ScopeEnterprise {
+		request := github.CreateEnterpriseRunnerGroupRequest{
+			Name:                     github.Ptr(name),
+			Visibility:               github.Ptr(GithubGroupVisibility),
+			AllowsPublicRepositories: github.Ptr(GithubGroupPublic),
+			RestrictedToWorkflows:    github.Ptr(restricted),
+			SelectedWorkflows:        GithubGroupWorkflows,
+		}
+		for _, v := range GithubGroupOrgs {
+			org, response, err := client.Organizations.Get(ctx, v)
+			CloseGithubResponse(response)
+			if err != nil {
+				return 0, err
+			}
+			request.SelectedOrganizationIDs = append(request.SelectedOrganizationIDs, org.GetID())
+		}
+
+		group, response, err := client.Enterprise.CreateEnterpriseRunnerGroup(ctx, target, request)
+		defer CloseGithubResponse(response)
+		if err != nil {
+			return 0, err
+		}
+		githubLogger.Info("Created runner group", "scope", scope, "target", target, "group", name, "id", group.GetID())
+		return group.GetID(), nil
+	}
+
+	request := github.CreateRunnerGroupRequest{
+		Name:                     github.Ptr(name),
+		Visibility:               github.Ptr(GithubGroupVisibility),
+		AllowsPublicRepositories: github.Ptr(GithubGroupPublic),
+		RestrictedToWorkflows:    github.Ptr(restricted),
+		SelectedWorkflows:        GithubGroupWorkflows,
+	}
+	for _, v := range GithubGroupRepos {
+		owner, repo, found := strings.Cut(v, "/")
+		if !found {
+			owner, repo = target, v
+		}
+		result, response, err := client.Repositories.Get(ctx, owner, repo)
+		CloseGithubResponse(response)
+		if err != nil {
+			return 0, err
+		}
+		request.SelectedRepositoryIDs = append(request.SelectedRepositoryIDs, result.GetID())
+	}
+
+	group, response, err := client.Actions.CreateOrganizationRunnerGroup(ctx, target, request)
+	defer CloseGithubResponse(response)
+	if err != nil {
+		return 0, err
+	}
+	githubLogger.Info("Created runner group", "scope", scope, "target", target, "group", name, "id", group.GetID())
+	return group.GetID(), nil
+}
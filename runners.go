@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// RunnersKey is the redis hash holding every runner we know about, keyed by runner id
+const RunnersKey = "runners"
+
+const (
+	StateProvisioning = "provisioning"
+	StateBooting      = "booting"
+	StateRunning      = "running"
+	StateDeleting     = "deleting"
+	StateCompleted    = "completed"
+	StateFailed       = "failed"
+)
+
+// how long finished runners stay around for anyone wanting to look at them
+var finishedRunnerRetention = 24 * time.Hour
+
+var runnerLogger = newLogger("runners")
+
+type Runner struct {
+	Id    string `json:"id"`
+	RunId string `json:"runId"`
+	JobId int64  `json:"jobId,omitempty"`
+	State string `json:"state"`
+	VMID  int    `json:"vmid,omitempty"`
+	Node  string `json:"node,omitempty"`
+	Owner string `json:"owner"`
+	IP    string `json:"ip,omitempty"`
+	Repo  string `json:"repo,omitempty"`
+	Org   string `json:"org,omitempty"`
+	//where the runner is registered on GitHub, and as what, so it can be removed if it never runs the job
+	Scope      string `json:"scope,omitempty"`
+	Target     string `json:"target,omitempty"`
+	GithubId   int64  `json:"githubId,omitempty"`
+	GithubName string `json:"githubName,omitempty"`
+	Workflow   string `json:"workflow,omitempty"`
+	Error      string `json:"error,omitempty"`
+	//Delivery is the webhook delivery that queued the job, for finding everything logged about it
+	Delivery string    `json:"delivery,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+
+	//timeline of the job, for seeing where the time went
+	Queued   time.Time `json:"queued,omitempty"`
+	Ready    time.Time `json:"ready,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	//Assignment is the job the runner picked up, it's filled in from RunnerAssignmentsKey when the runner is read
+	Assignment *Assignment `json:"assignment,omitempty"`
+}
+
+func NewRunner(job QueuedJob) *Runner {
+	runner := &Runner{
+		Id:       newRunnerId(job.RunId),
+		RunId:    job.RunId,
+		JobId:    job.JobId,
+		Repo:     job.Repo,
+		Org:      job.org().Name,
+		Scope:    job.Scope,
+		Target:   job.Target,
+		Workflow: job.Workflow,
+		Delivery: job.DeliveryId,
+		State:    StateProvisioning,
+		Node:     ProxmoxNode,
+		Owner:    InstanceId,
+		Created:  time.Now(),
+	}
+	runner.Queued = job.Queued
+	return runner
+}
+
+// job is the job the runner was made for, as far as the runner knows it
+func (r *Runner) job() QueuedJob {
+	job := NewQueuedJob(r.RunId, r.Delivery)
+	job.JobId = r.JobId
+	job.Repo = r.Repo
+	job.Org = r.Org
+	job.Scope = r.Scope
+	job.Target = r.Target
+	job.Workflow = r.Workflow
+	return job
+}
+
+// IsActive is if the runner still has, or is about to have, a VM
+func (r *Runner) IsActive() bool {
+	return r.State != StateCompleted && r.State != StateFailed
+}
+
+func (r *Runner) SetState(state string) {
+	r.State = state
+	r.Save()
+}
+
+// SetError records why the runner didn't make it. Only the first error is kept, that's the interesting one.
+func (r *Runner) SetError(err error) {
+	if r.Error == "" && err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Finish marks the runner as done
+func (r *Runner) Finish(err error) {
+	r.SetError(err)
+	r.Finished = time.Now()
+	if r.Error != "" {
+		r.SetState(StateFailed)
+	} else {
+		r.SetState(StateCompleted)
+	}
+}
+
+// Save writes the runner to redis. Failing to track a runner shouldn't fail the job, so this only logs.
+func (r *Runner) Save() {
+	r.Updated = time.Now()
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = rdb.HSet(context.Background(), RunnersKey, r.Id, data).Err()
+	}
+	if err != nil {
+		runnerLogger.Error("Failed to save runner", "runner", r.Id, "error", err)
+	}
+}
+
+// IsAbandoned is if whoever was driving the runner has gone away without finishing it
+func (r *Runner) IsAbandoned() bool {
+	return r.IsActive() && !isInstanceAlive(r.Owner)
+}
+
+func getRunner(id string) (*Runner, error) {
+	data, err := rdb.HGet(context.Background(), RunnersKey, id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runner := &Runner{}
+	if err = json.Unmarshal(data, runner); err != nil {
+		return nil, err
+	}
+	return runner, loadAssignments(context.Background(), runner)
+}
+
+// listRunners returns every runner, newest first
+func listRunners() ([]*Runner, error) {
+	data, err := rdb.HGetAll(context.Background(), RunnersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	runners := make([]*Runner, 0, len(data))
+	for _, v := range data {
+		runner := &Runner{}
+		if err = json.Unmarshal([]byte(v), runner); err != nil {
+			continue
+		}
+		runners = append(runners, runner)
+	}
+
+	sort.Slice(runners, func(i, j int) bool {
+		return runners[i].Created.After(runners[j].Created)
+	})
+	return runners, loadAssignments(context.Background(), runners...)
+}
+
+// activeRunnerIds returns the ids of every runner something is still working on
+func activeRunnerIds() map[string]bool {
+	result := make(map[string]bool)
+	runners, err := listRunners()
+	if err != nil {
+		return result
+	}
+	for _, v := range runners {
+		if v.IsActive() && !v.IsAbandoned() {
+			result[v.Id] = true
+		}
+	}
+	return result
+}
+
+// org is whose config the runner was registered with. Runners from older versions didn't record it.
+func (r *Runner) org() *OrgConfig {
+	if r.Org != "" {
+		return getOrg(r.Org)
+	}
+	return orgFor(r.Scope, r.Target)
+}
+
+// Deregister removes the runner from GitHub, for when its VM is going away without having finished a job.
+// Like Save, this only logs, there's nothing else to be done about it.
+func (r *Runner) Deregister(ctx context.Context, logger *slog.Logger) {
+	if r.GithubId == 0 {
+		return
+	}
+	if err := RemoveGithubRunner(ctx, r.org(), r.Scope, r.Target, r.GithubId); err != nil {
+		logger.Error("Failed to deregister runner", "runner", r.Id, "github_runner", r.GithubName, "error", err)
+		return
+	}
+	logger.Info("Deregistered runner", "runner", r.Id, "github_runner", r.GithubName)
+	r.GithubId = 0
+	r.Save()
+}
+
+func deleteRunner(id string) error {
+	rdb.HDel(context.Background(), RunnerAssignmentsKey, id)
+	return rdb.HDel(context.Background(), RunnersKey, id).Err()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Finished logs can be pushed to anything speaking the S3 API (AWS, MinIO, R2...)
+var LogExportEndpoint = env.Get("log.s3.endpoint")
+var LogExportBucket = env.Get("log.s3.bucket")
+var LogExportRegion = env.GetOr("log.s3.region", "us-east-1")
+var LogExportPrefix = env.Get("log.s3.prefix")
+var LogExportAccessKey = env.Get("log.s3.accessKey")
+var LogExportSecretKey = env.Get("log.s3.secretKey")
+var LogExportEnabled = LogExportEndpoint != "" && LogExportBucket != ""
+
+// logs are exported as runners finish, so a bucket that stops answering mustn't hold the worker up for long
+var logExportClient = &http.Client{Timeout: time.Duration(env.GetIntOr("log.s3.timeout", 60)) * time.Second}
+
+func exportLog(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	key := LogExportPrefix + filepath.Base(path)
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(LogExportEndpoint, "/"), LogExportBucket, s3Escape(key)))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		request.Header.Set("Content-Type", "application/gzip")
+	} else {
+		request.Header.Set("Content-Type", "text/plain")
+	}
+	signS3Request(request, data, time.Now().UTC())
+
+	response, err := logExportClient.Do(request)
+	defer CloseResponse(response)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("upload of %s failed (%d) %s", key, response.StatusCode, string(body))
+	}
+	return nil
+}
+
+// signS3Request adds AWS signature v4 headers to the request
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(request *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for k, v := range request.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := new(strings.Builder)
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, LogExportRegion)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+LogExportSecretKey), date)
+	key = hmacSha256(key, LogExportRegion)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", LogExportAccessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape encodes each part of the key the way S3 expects, which is stricter than url.PathEscape
+func s3Escape(key string) string {
+	parts := strings.Split(key, "/")
+	for i, v := range parts {
+		builder := new(strings.Builder)
+		for _, c := range []byte(v) {
+			if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+				builder.WriteByte(c)
+			} else {
+				_, _ = fmt.Fprintf(builder, "%%%02X", c)
+			}
+		}
+		parts[i] = builder.String()
+	}
+	return strings.Join(parts, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"github.com/redis/go-redis/v9"
+	"strings"
+)
+
+// QueueGroupsKey is the set of groups which may have jobs waiting. Each group has its own queue,
+// QueueName:<group>, plus QueueName:<group>:priority for jobs with a priority label.
+const QueueGroupsKey = "workflow_queue_groups"
+
+// QueueGroupNames are groups of repos scheduled together, i.e. a team. Each one is configured with
+// queue.group.<name>.repos, queue.group.<name>.weight and queue.group.<name>.max.
+// Repos not in any group are scheduled on their own.
+var QueueGroupNames = splitList(env.Get("queue.groups"))
+
+// QueueMax is how many runners a group can have at once when it doesn't set its own, 0 is no limit
+var QueueMax = env.GetInt("queue.max")
+
+// QueuePriorityLabels put a job ahead of everything else waiting, as long as its group is under its limit
+var QueuePriorityLabels = splitList(env.Get("queue.priority.labels"))
+
+var ErrGroupAtCapacity = errors.New("group has reached its runner limit")
+var ErrOrgAtCapacity = errors.New("org has reached its runner limit")
+
+type QueueGroup struct {
+	Name   string
+	Weight int
+	Max    int
+}
+
+var queueGroups, repoGroups = loadQueueGroups()
+
+func loadQueueGroups() (map[string]QueueGroup, map[string]string) {
+	groups := make(map[string]QueueGroup)
+	repos := make(map[string]string)
+	for _, v := range QueueGroupNames {
+		groups[v] = QueueGroup{
+			Name:   v,
+			Weight: max(env.GetIntOr("queue.group."+v+".weight", 1), 1),
+			Max:    env.GetIntOr("queue.group."+v+".max", QueueMax),
+		}
+		for _, repo := range splitList(env.Get("queue.group." + v + ".repos")) {
+			repos[strings.ToLower(repo)] = v
+		}
+	}
+	return groups, repos
+}
+
+// groupForRepo is who the repo is scheduled with, itself unless it's been put in a group
+func groupForRepo(repo string) QueueGroup {
+	if repo == "" {
+		repo = "default"
+	}
+	if name, exists := repoGroups[strings.ToLower(repo)]; exists {
+		return queueGroups[name]
+	}
+	return QueueGroup{Name: strings.ToLower(repo), Weight: 1, Max: QueueMax}
+}
+
+func getQueueGroup(name string) QueueGroup {
+	if group, exists := queueGroups[name]; exists {
+		return group
+	}
+	return QueueGroup{Name: name, Weight: 1, Max: QueueMax}
+}
+
+func (g QueueGroup) queueKey() string {
+	return QueueName + ":" + g.Name
+}
+
+func (g QueueGroup) priorityKey() string {
+	return QueueName + ":" + g.Name + ":priority"
+}
+
+// queueKey is the queue the job waits in
+func (j QueuedJob) queueKey() string {
+	group := groupForRepo(j.Repo)
+	for _, v := range j.Labels {
+		if contains(QueuePriorityLabels, v) {
+			return group.priorityKey()
+		}
+	}
+	return group.queueKey()
+}
+
+// enqueueJob adds the job to the back of its group's queue
+func enqueueJob(ctx context.Context, job QueuedJob) error {
+	if err := rdb.RPush(ctx, job.queueKey(), job.encode()).Err(); err != nil {
+		return err
+	}
+	return rdb.SAdd(ctx, QueueGroupsKey, groupForRepo(job.Repo).Name).Err()
+}
+
+// requeueJob puts a job taken off the given queue back at the front, like it was never taken
+func requeueJob(key string, value string, job QueuedJob) {
+	rdb.LPush(context.Background(), key, value)
+	rdb.SAdd(context.Background(), QueueGroupsKey, groupForRepo(job.Repo).Name)
+}
+
+// skipJob puts a job taken off the given queue at the back, as it was, for a worker which can run it
+func skipJob(key string, value string, job QueuedJob) {
+	rdb.RPush(context.Background(), key, value)
+	rdb.SAdd(context.Background(), QueueGroupsKey, groupForRepo(job.Repo).Name)
+}
+
+// forget the group once both its queues are empty, checked together so a job added meanwhile isn't missed
+var removeEmptyGroupScript = redis.NewScript(`
+if redis.call("llen", KEYS[1]) == 0 and redis.call("llen", KEYS[2]) == 0 then
+	return redis.call("srem", KEYS[3], ARGV[1])
+end
+return 0
+`)
+
+// activeCounts counts the runners each group, and each org, has going
+func activeCounts() (groups map[string]int, orgs map[string]int, err error) {
+	runners, err := listRunners()
+	if err != nil {
+		return nil, nil, err
+	}
+	groups = make(map[string]int)
+	orgs = make(map[string]int)
+	for _, v := range runners {
+		if v.IsActive() && !v.IsAbandoned() {
+			groups[groupForRepo(v.Repo).Name]++
+			orgs[strings.ToLower(v.Org)]++
+		}
+	}
+	return groups, orgs, nil
+}
+
+// orgAtCapacity is if the org the job is for already has as many runners as it's allowed
+func orgAtCapacity(job QueuedJob, orgs map[string]int) bool {
+	org := job.org()
+	return org.Max > 0 && orgs[strings.ToLower(org.Name)] >= org.Max
+}
+
+// nextJob takes the next job to run off the queues, returning the queue it came from so it can be put back.
+// Priority jobs go first. Otherwise the group with the fewest runners for its weight goes next, so a repo
+// with a big matrix gets its share without starving everyone else. Groups at their limit are skipped,
+// as are groups whose next job is for an org at its limit.
+// Returns an empty key if there's nothing that can run.
+func nextJob(ctx context.Context) (key string, value string, err error) {
+	names, err := rdb.SMembers(ctx, QueueGroupsKey).Result()
+	if err != nil || len(names) == 0 {
+		return "", "", err
+	}
+	active, orgs, err := activeCounts()
+	if err != nil {
+		return "", "", err
+	}
+
+	var best QueueGroup
+	var bestScore float64
+	var bestPriority, found bool
+	for _, v := range names {
+		group := getQueueGroup(v)
+		if group.Max > 0 && active[group.Name] >= group.Max {
+			continue
+		}
+
+		priority, err := rdb.LLen(ctx, group.priorityKey()).Result()
+		if err != nil {
+			return "", "", err
+		}
+		waiting, err := rdb.LLen(ctx, group.queueKey()).Result()
+		if err != nil {
+			return "", "", err
+		}
+		if priority == 0 && waiting == 0 {
+			removeEmptyGroupScript.Run(ctx, rdb, []string{group.queueKey(), group.priorityKey(), QueueGroupsKey}, group.Name)
+			continue
+		}
+
+		head := group.queueKey()
+		if priority > 0 {
+			head = group.priorityKey()
+		}
+		if value, err := rdb.LIndex(ctx, head, 0).Result(); err == nil {
+			if job, err := decodeJob(value); err == nil && orgAtCapacity(job, orgs) {
+				continue
+			}
+		}
+
+		score := float64(active[group.Name]) / float64(group.Weight)
+		hasPriority := priority > 0
+		if !found || (hasPriority && !bestPriority) || (hasPriority == bestPriority && score < bestScore) {
+			best, bestScore, bestPriority, found = group, score, hasPriority, true
+		}
+	}
+	if !found {
+		return "", "", nil
+	}
+
+	key = best.queueKey()
+	if bestPriority {
+		key = best.priorityKey()
+	}
+	value, err = rdb.LPop(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		//another worker got there first
+		return "", "", nil
+	}
+	return key, value, err
+}
+
+// jobsWaiting is a cheap check for anything queued, so an idle worker doesn't have to ask Proxmox and go
+// through every group. Jobs left in the single queue older versions used are moved into their groups first,
+// an older instance can still be putting them there mid upgrade.
+func jobsWaiting(ctx context.Context) (bool, error) {
+	migrateQueue()
+	count, err := rdb.SCard(ctx, QueueGroupsKey).Result()
+	return count > 0, err
+}
+
+// pendingQueueKeys lists every queue with jobs waiting in it
+func pendingQueueKeys(ctx context.Context) ([]string, error) {
+	names, err := rdb.SMembers(ctx, QueueGroupsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	//anything left over in the old single queue still counts
+	keys := []string{QueueName}
+	for _, v := range names {
+		group := getQueueGroup(v)
+		keys = append(keys, group.priorityKey(), group.queueKey())
+	}
+	return keys, nil
+}
+
+// listPendingJobs returns every job waiting to be run, across all the groups
+func listPendingJobs() ([]QueuedJob, error) {
+	keys, err := pendingQueueKeys(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]QueuedJob, 0)
+	for _, v := range keys {
+		jobs, err := listQueuedJobs(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, jobs...)
+	}
+	return result, nil
+}
+
+// countPendingJobs is how many jobs are waiting to be run
+func countPendingJobs() (int64, error) {
+	keys, err := pendingQueueKeys(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, v := range keys {
+		count, err := rdb.LLen(context.Background(), v).Result()
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// removePendingJob drops the run from whichever queues it's waiting in
+func removePendingJob(runId string) (int64, error) {
+	keys, err := pendingQueueKeys(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, v := range keys {
+		removed, err := removeQueuedJob(v, runId)
+		if err != nil {
+			return total, err
+		}
+		total += removed
+	}
+	return total, nil
+}
+
+// removeJobId drops one entry for the job from the queues or the retries, if it's waiting in any of them
+func removeJobId(ctx context.Context, jobId int64) (bool, error) {
+	keys, err := pendingQueueKeys(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		values, err := rdb.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return false, err
+		}
+		for _, v := range values {
+			if job, _ := decodeJob(v); job.JobId != jobId {
+				continue
+			}
+			removed, err := rdb.LRem(ctx, key, 1, v).Result()
+			if err != nil || removed > 0 {
+				return removed > 0, err
+			}
+		}
+	}
+
+	values, err := rdb.ZRange(ctx, RetryQueueName, 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if job, _ := decodeJob(v); job.JobId == jobId {
+			removed, err := rdb.ZRem(ctx, RetryQueueName, v).Result()
+			return removed > 0, err
+		}
+	}
+	return false, nil
+}
+
+// migrateQueue moves jobs from the single queue older versions used into their groups. Anything which can't
+// be moved goes back on the end, it only goes through what was there when it started so it doesn't go round forever.
+func migrateQueue() {
+	count, err := rdb.LLen(context.Background(), QueueName).Result()
+	if err != nil {
+		return
+	}
+	for ; count > 0; count-- {
+		value, err := rdb.LPop(context.Background(), QueueName).Result()
+		if err != nil {
+			return
+		}
+		job, err := decodeJob(value)
+		if isCorrupt(err) {
+			workerLogger.Error("Dropping job we can't read", "job", value, "error", err)
+			continue
+		}
+		if err == nil {
+			err = enqueueJob(context.Background(), job)
+		}
+		if err != nil {
+			workerLogger.Warn("Leaving job in the old queue", append(job.logAttrs(), "error", err)...)
+			rdb.RPush(context.Background(), QueueName, value)
+		}
+	}
+}
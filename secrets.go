@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RunnerEnvNames are the variables written to the runner's .env, each value comes from runner.env.<name>
+var RunnerEnvNames = splitList(env.Get("runner.env"))
+
+// RunnerSecretNames are files dropped onto the VM, each value comes from runner.secret.<name>
+// and is written to runner.secret.<name>.path
+var RunnerSecretNames = splitList(env.Get("runner.secrets"))
+
+// values shorter than this are not worth redacting, it would just mangle the logs
+const minRedactLength = 4
+
+type RunnerEnv struct {
+	Vars    map[string]string
+	Secrets []SecretFile
+}
+
+type SecretFile struct {
+	Name string
+	Path string
+	Data string
+}
+
+// loadRunnerEnv reads everything we need to inject into the org's VMs. Values go through env.Get,
+// so any of them can be pointed at a file with the .file suffix. An org's own values replace the
+// runner.* ones, see OrgConfig.
+func loadRunnerEnv(org *OrgConfig) (*RunnerEnv, error) {
+	get := func(key string) string {
+		if org == defaultOrg {
+			return env.Get(key)
+		}
+		return env.GetOr("github.org."+org.Name+"."+key, env.Get(key))
+	}
+
+	result := &RunnerEnv{Vars: make(map[string]string)}
+	for _, v := range mergeLists(RunnerEnvNames, org.RunnerEnv) {
+		value := get("runner.env." + v)
+		//the runner reads .env a line at a time and doesn't understand quoting, so there's no way to write these
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("env %s can't contain a newline", v)
+		}
+		result.Vars[v] = value
+	}
+
+	for _, v := range mergeLists(RunnerSecretNames, org.RunnerSecrets) {
+		target := get("runner.secret." + v + ".path")
+		if target == "" {
+			return nil, fmt.Errorf("secret %s has no path", v)
+		}
+		result.Secrets = append(result.Secrets, SecretFile{
+			Name: v,
+			Path: target,
+			Data: get("runner.secret." + v),
+		})
+	}
+	return result, nil
+}
+
+// Redacted lists every value which should never show up in a log. Env values aren't secret,
+// they'd only make the log harder to read, so it's just the secret files.
+func (r *RunnerEnv) Redacted() []string {
+	var values []string
+	for _, v := range r.Secrets {
+		values = append(values, v.Data)
+		//multi-line secrets tend to be logged a line at a time
+		values = append(values, strings.Split(v.Data, "\n")...)
+	}
+	return values
+}
+
+// inject writes the runner's .env and uploads the secret files, neither readable by anyone else on the VM
+func (r *RunnerEnv) inject(client *ssh.Client, logger *slog.Logger) error {
+	if len(r.Vars) > 0 {
+		names := make([]string, 0, len(r.Vars))
+		for k := range r.Vars {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		buf := new(bytes.Buffer)
+		for _, k := range names {
+			_, _ = fmt.Fprintf(buf, "%s=%s\n", k, r.Vars[k])
+		}
+
+		logger.Info("Writing runner environment", "names", strings.Join(names, ","))
+		if err := uploadPrivateData(client, ".env", buf); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range r.Secrets {
+		logger.Info("Uploading secret", "name", v.Name, "path", v.Path)
+		if err := uploadPrivateData(client, v.Path, strings.NewReader(v.Data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPrivateData is uploadData, but the file is locked down before anything is written to it
+func uploadPrivateData(client *ssh.Client, target string, data io.Reader) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer Close(sftpClient)
+
+	if dir := path.Dir(target); dir != "." {
+		if err = sftpClient.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	targetFile, err := sftpClient.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer Close(targetFile)
+
+	if err = targetFile.Chmod(0600); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(targetFile, data)
+	return err
+}
+
+// Redactor replaces secret values in everything written through it
+type Redactor struct {
+	writer   io.Writer
+	replacer *strings.Replacer
+}
+
+func NewRedactor(writer io.Writer, secrets []string) io.Writer {
+	//longest first, so a secret containing another isn't half replaced
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	var pairs []string
+	for _, v := range secrets {
+		v = strings.TrimSpace(v)
+		if len(v) < minRedactLength {
+			continue
+		}
+		pairs = append(pairs, v, "***")
+
+		//structured logs quote values, so a secret with quotes or backslashes shows up escaped
+		if quoted := strconv.Quote(v); quoted[1:len(quoted)-1] != v {
+			pairs = append(pairs, quoted[1:len(quoted)-1], "***")
+		}
+	}
+	if len(pairs) == 0 {
+		return writer
+	}
+	return &Redactor{writer: writer, replacer: strings.NewReplacer(pairs...)}
+}
+
+func (r *Redactor) Write(p []byte) (int, error) {
+	_, err := io.WriteString(r.writer, r.replacer.Replace(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// mergeLists is first followed by anything in second it doesn't already have
+func mergeLists(first []string, second []string) []string {
+	result := append([]string{}, first...)
+	for _, v := range second {
+		if !slices.Contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
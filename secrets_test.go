@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunnerEnvRedacted(t *testing.T) {
+	runnerEnv := &RunnerEnv{
+		Vars: map[string]string{"DEPLOY_REGION": "eu-west-1"},
+		Secrets: []SecretFile{
+			{Name: "npmrc", Path: ".npmrc", Data: "//registry.npmjs.org/:_authToken=npm_secret"},
+			{Name: "key", Path: ".ssh/id", Data: "first-line\nsecond-line"},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	writer := NewRedactor(buf, runnerEnv.Redacted())
+	_, _ = writer.Write([]byte("region=eu-west-1 token=//registry.npmjs.org/:_authToken=npm_secret\nsecond-line\n"))
+
+	output := buf.String()
+	if !strings.Contains(output, "region=eu-west-1") {
+		t.Errorf("env value was redacted: %s", output)
+	}
+	if strings.Contains(output, "npm_secret") {
+		t.Errorf("secret wasn't redacted: %s", output)
+	}
+	if strings.Contains(output, "second-line") {
+		t.Errorf("line of a multi-line secret wasn't redacted: %s", output)
+	}
+}
+
+func TestLoadRunnerEnvForOrg(t *testing.T) {
+	envNames, secretNames := RunnerEnvNames, RunnerSecretNames
+	defer func() {
+		RunnerEnvNames, RunnerSecretNames = envNames, secretNames
+	}()
+	RunnerEnvNames = []string{"SHARED", "REGION"}
+	RunnerSecretNames = nil
+	t.Setenv("RUNNER_ENV_SHARED", "everyone")
+	t.Setenv("RUNNER_ENV_REGION", "eu-west-1")
+	t.Setenv("GITHUB_ORG_ACME_RUNNER_ENV_REGION", "us-east-1")
+	t.Setenv("GITHUB_ORG_ACME_RUNNER_ENV_TEAM", "acme")
+	t.Setenv("GITHUB_ORG_ACME_RUNNER_SECRET_NPMRC", "npm_secret")
+	t.Setenv("GITHUB_ORG_ACME_RUNNER_SECRET_NPMRC_PATH", ".npmrc")
+
+	org := &OrgConfig{Name: "acme", RunnerEnv: []string{"TEAM", "REGION"}, RunnerSecrets: []string{"NPMRC"}}
+	runnerEnv, err := loadRunnerEnv(org)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"SHARED": "everyone", "REGION": "us-east-1", "TEAM": "acme"}
+	if len(runnerEnv.Vars) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, runnerEnv.Vars)
+	}
+	for k, v := range expected {
+		if runnerEnv.Vars[k] != v {
+			t.Errorf("expected %s=%s, got %s", k, v, runnerEnv.Vars[k])
+		}
+	}
+	if len(runnerEnv.Secrets) != 1 || runnerEnv.Secrets[0].Path != ".npmrc" || runnerEnv.Secrets[0].Data != "npm_secret" {
+		t.Errorf("expected the org's secret, got %v", runnerEnv.Secrets)
+	}
+
+	runnerEnv, err = loadRunnerEnv(defaultOrg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runnerEnv.Vars["REGION"] != "eu-west-1" || len(runnerEnv.Vars) != 2 || len(runnerEnv.Secrets) != 0 {
+		t.Errorf("expected only the shared settings, got %v %v", runnerEnv.Vars, runnerEnv.Secrets)
+	}
+}
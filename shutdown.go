@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownContext is cancelled on SIGINT or SIGTERM. SIGUSR1 toggles draining on this instance,
+// so it can be emptied out ahead of being stopped.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	go func() {
+		for range drain {
+			SetDraining(!draining.Load())
+		}
+	}()
+
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
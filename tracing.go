@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// TracingEndpoint is the OTLP/HTTP collector spans are sent to, i.e. http://localhost:4318. Tracing is off without it.
+var TracingEndpoint = env.Get("tracing.endpoint")
+
+var tracer = otel.Tracer("github.com/pufferpanel/github-runner-scaler")
+
+var tracingLogger = newLogger("tracing")
+
+// startTracing sets up exporting spans if there's somewhere to send them.
+// The returned func flushes whatever hasn't been sent yet.
+func startTracing() func() {
+	//always carry trace context through the queue, even if this instance doesn't export
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if TracingEndpoint == "" {
+		return func() {}
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(TracingEndpoint))
+	if err != nil {
+		tracingLogger.Error("Failed to create trace exporter", "error", err)
+		return func() {}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("github-runner-scaler"),
+			semconv.ServiceInstanceID(InstanceId),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			tracingLogger.Error("Failed to flush traces", "error", err)
+		}
+	}
+}
+
+// injectTraceContext captures the span in ctx so it can be carried along with a queued job
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTraceContext picks back up the span a job was queued under
+func extractTraceContext(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// spanAttrs are the attributes every span about a job carries
+func (j QueuedJob) spanAttrs() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("github.delivery", j.DeliveryId),
+		attribute.String("github.run_id", j.RunId),
+		attribute.Int64("github.job_id", j.JobId),
+		attribute.String("github.repo", j.Repo),
+		attribute.String("github.workflow", j.Workflow),
+		attribute.Int("job.attempt", j.Attempt),
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-github/v73/github"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// GithubSecrets are what webhooks can be signed with. github.secret.previous is for rotating, set it to the
+// old secret while GitHub is switched over to the new one, then remove it.
+var GithubSecrets = nonEmpty([]byte(env.Get("github.secret")), []byte(env.Get("github.secret.previous")))
+
+// WebhookMaxSize is the most a webhook can send, in bytes. GitHub's own limit is 25MB.
+var WebhookMaxSize = int64(env.GetIntOr("webhook.max.size", 25*1024*1024))
+
+// WebhookAllow are the addresses webhooks are taken from, as CIDRs. WebhookAllowFile adds more from a file,
+// either one per line or GitHub's api.github.com/meta, which lists its hook ranges. Anyone is allowed without either.
+var WebhookAllow = splitList(env.Get("webhook.allow"))
+var WebhookAllowFile = env.Get("webhook.allow.file")
+
+// WebhookRateLimit is how many webhooks one address can send a minute, 0 is no limit
+var WebhookRateLimit = env.GetInt("webhook.ratelimit")
+
+// WebTrustedProxies are the proxies whose X-Forwarded-For is believed, anything else is seen as the client
+var WebTrustedProxies = splitList(env.Get("web.proxies"))
+
+// webhookRateKey counts webhooks from an address, one key per minute
+const webhookRateKey = "webhook_rate"
+
+var ErrNoWebhookSecret = errors.New("github.secret is not set, refusing to accept unsigned webhooks")
+
+func nonEmpty(values ...[]byte) [][]byte {
+	result := make([][]byte, 0, len(values))
+	for _, v := range values {
+		if len(v) > 0 {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// webhookGuard turns away webhooks from where GitHub doesn't send them, or from anyone sending too many
+func webhookGuard() (gin.HandlerFunc, error) {
+	networks, err := loadWebhookAllow()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.ClientIP())
+		if len(networks) > 0 && !containsIP(networks, ip) {
+			webLogger.Warn("Webhook from address not allowed", "ip", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		if WebhookRateLimit > 0 && !allowWebhook(c.Request.Context(), c.ClientIP()) {
+			webLogger.Warn("Webhook rate limit hit", "ip", c.ClientIP())
+			c.Header("Retry-After", "60")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, WebhookMaxSize)
+		c.Next()
+	}, nil
+}
+
+func loadWebhookAllow() ([]*net.IPNet, error) {
+	values := append([]string{}, WebhookAllow...)
+	if WebhookAllowFile != "" {
+		data, err := os.ReadFile(WebhookAllowFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var meta struct {
+			Hooks []string `json:"hooks"`
+		}
+		if json.Unmarshal(data, &meta) == nil {
+			values = append(values, meta.Hooks...)
+		} else {
+			for _, v := range strings.Split(string(data), "\n") {
+				if v = strings.TrimSpace(v); v != "" && !strings.HasPrefix(v, "#") {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		//single addresses are fine too
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook allow %q: %w", v, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, v := range networks {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowWebhook counts the webhook against the address, shared between instances. If redis is down
+// the webhook is let through, it'll most likely fail to queue anyway.
+func allowWebhook(ctx context.Context, ip string) bool {
+	key := fmt.Sprintf("%s:%s:%d", webhookRateKey, ip, time.Now().Unix()/60)
+	count, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return true
+	}
+	if count == 1 {
+		rdb.Expire(ctx, key, 2*time.Minute)
+	}
+	return count <= int64(WebhookRateLimit)
+}
+
+// validateWebhook checks the webhook was signed with one of our secrets and returns its payload
+func validateWebhook(request *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := request.Header.Get(github.SHA256SignatureHeader)
+	if signature == "" {
+		signature = request.Header.Get(github.SHA1SignatureHeader)
+	}
+	contentType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range GithubSecrets {
+		var payload []byte
+		payload, err = github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), signature, v)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	if err == nil {
+		err = ErrNoWebhookSecret
+	}
+	return nil, err
+}
@@ -2,32 +2,135 @@ package main
 
 import (
 	"context"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/github-runner-scaler/env"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const QueueName = "workflow_queue"
 const DeleteQueueName = "workflow_delete_queue"
 
-func StartWorkers() {
+// ShutdownTimeout is how long we wait for runners on shutdown before leaving them to the reconciler.
+// With ShutdownDrain set, we wait for every runner no matter how long it takes.
+var ShutdownTimeout = time.Duration(env.GetIntOr("shutdown.timeout", 300)) * time.Second
+var ShutdownDrain = env.GetBool("shutdown.drain")
+
+// how long a blocking pop waits, which is also how long shutdown can take to be noticed
+var queuePollTimeout = 5 * time.Second
+
+// how long to wait before looking at the queues again when there's nothing to run
+var queuePollInterval = 2 * time.Second
+
+var workerLogger = newLogger("worker")
+
+// workers are the queue loops, inflight are the runners they've kicked off
+var workers sync.WaitGroup
+var inflight sync.WaitGroup
+var inflightCount atomic.Int64
+
+// draining stops this instance taking new jobs, without stopping the ones it has
+var draining atomic.Bool
+
+func StartWorkers(ctx context.Context) {
+	StartHeartbeat()
+
 	//kick off queue processor
-	go runWorker()
+	workers.Add(1)
+	go runWorker(ctx)
 
 	//only run a single deleter
-	go deleteWorker()
+	workers.Add(1)
+	go deleteWorker(ctx)
+
+	workers.Add(1)
+	go retryWorker(ctx)
+
+	StartLogRetention()
+	StartReconciler()
 }
 
-func runWorker() {
-	logger := log.New(os.Stdout, "[Runner] ", log.LstdFlags|log.Lmicroseconds)
+// StopWorkers waits for the queue loops to notice shutdown, then for the runners in flight.
+// Anything still going after the timeout is left for the reconciler.
+func StopWorkers() {
+	workerLogger.Info("Shutting down, no longer taking jobs")
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		inflight.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if ShutdownDrain {
+		workerLogger.Info("Draining, waiting for runners to finish", "runners", inflightCount.Load())
+	} else {
+		workerLogger.Info("Waiting for runners to finish", "timeout", ShutdownTimeout, "runners", inflightCount.Load())
+		timeout = time.After(ShutdownTimeout)
+	}
+
+	select {
+	case <-done:
+		workerLogger.Info("All runners finished")
+	case <-timeout:
+		workerLogger.Warn("Leaving runners to the reconciler", "runners", inflightCount.Load())
+	}
+
+	//our runners are all saved as we go, once the heartbeat is gone they're fair game
+	StopHeartbeat()
+}
+
+func SetDraining(drain bool) {
+	draining.Store(drain)
+	if drain {
+		workerLogger.Info("Draining, no longer taking jobs")
+	} else {
+		workerLogger.Info("No longer draining, taking jobs again")
+	}
+}
+
+func runWorker(ctx context.Context) {
+	defer workers.Done()
+
+	logger := workerLogger
 	var numVms int
 	var err error
 	var vms []VM
-	for {
+	var paused, waiting bool
+	var job QueuedJob
+	var rejection *PolicyRejection
+	var key, value string
+	for ctx.Err() == nil {
+		paused, err = isProvisioningPaused()
+		if err != nil {
+			logger.Error("Failed to check if provisioning is paused", "error", err)
+		}
+		if paused || draining.Load() {
+			sleep(ctx, 10*time.Second)
+			continue
+		}
+
+		//nothing else is worth asking about until there's a job to run
+		waiting, err = jobsWaiting(ctx)
+		if err != nil {
+			logger.Error("Failed to read queue", "error", err)
+			sleep(ctx, time.Second)
+			continue
+		}
+		if !waiting {
+			sleep(ctx, queuePollInterval)
+			continue
+		}
+
 		//check how many VMs we have running, only permit a limit
 		//if the limit is reached, sleep and then check later
-		vms, err = getVMs()
+		vms, err = getVMs(ctx)
 
 		numVms = 0
 		for _, v := range vms {
@@ -39,41 +142,143 @@ func runWorker() {
 
 		if numVms >= NumWorkers || err != nil {
 			if err != nil {
-				logger.Printf("Failed to get number of running VMs: %s", err)
+				logger.Error("Failed to get number of running VMs", "error", err)
 			} else {
-				logger.Printf("Number of VMs exceeded (%d of %d), sleeping", numVms, NumWorkers)
+				logger.Info("Number of VMs exceeded, sleeping", "vms", numVms, "max", NumWorkers)
 			}
-			time.Sleep(time.Minute)
+			sleep(ctx, time.Minute)
 			continue
 		}
 
-		cmd := rdb.BLPop(context.Background(), 0, QueueName)
-		if cmd.Err() != nil {
-			logger.Printf("Error: %s", cmd.Err())
+		//don't hand the context to redis, cancelling mid-pop can lose the job
+		key, value, err = nextJob(context.Background())
+		if err != nil {
+			logger.Error("Failed to read queue", "error", err)
+			sleep(ctx, time.Second)
+			continue
+		}
+		if key == "" {
+			sleep(ctx, queuePollInterval)
+			continue
+		}
+
+		job, err = decodeJob(value)
+		if errors.Is(err, ErrJobVersion) {
+			//mid upgrade, leave it for one of the newer instances
+			logger.Warn("Skipping job from a newer version", "error", err)
+			skipJob(key, value, job)
+			sleep(ctx, 10*time.Second)
+			continue
+		}
+		if err != nil {
+			logger.Error("Dropping job we can't read", "job", value, "error", err)
+			continue
+		}
+
+		//we may have been paused or shut down while waiting on the queue, put it back where it was
+		if paused, _ = isProvisioningPaused(); paused || draining.Load() || ctx.Err() != nil {
+			requeueJob(key, value, job)
 			continue
 		}
 
-		id := cmd.Val()[1]
-		logger.Printf("Processing job: %s", id)
+		job.Attempt++
+		jobLogger := logger.With(job.logAttrs()...)
+		jobLogger.Info("Processing job")
+
+		jobCtx, span := tracer.Start(extractTraceContext(context.Background(), job.TraceContext), "dequeue",
+			trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(job.spanAttrs()...))
+		span.End()
 
-		//create VM
-		err = cloneVM(id)
+		rejection, err = checkRunPolicy(jobCtx, job)
+		if errors.Is(err, ErrRateLimited) {
+			delayJob(job, job.org().rateLimitDelay(), jobLogger.With("reason", err))
+			continue
+		}
 		if err != nil {
-			logger.Printf("Failed to create vm: %s", err)
+			jobLogger.Warn("Failed to look up the run for the policy", "error", err)
+			retryJob(job, fmt.Errorf("policy lookup failed: %w", err), jobLogger)
+			continue
+		}
+		if rejection != nil {
+			jobLogger.Warn("Job rejected by policy", "rule", rejection.Rule, "value", rejection.Value)
+			countPolicyRejection(jobCtx, rejection)
+			continue
+		}
+
+		//the runner can't be registered until the limit resets, so there's no point making a VM for it before then
+		if delay := job.org().rateLimitDelay(); delay > GithubRateLimitMaxWait {
+			delayJob(job, delay, jobLogger.With("reason", ErrRateLimited))
+			continue
+		}
+
+		//create VM, this deliberately doesn't use ctx so shutting down doesn't cut provisioning off half way
+		err = cloneVM(jobCtx, job)
+		if errors.Is(err, ErrAtCapacity) || errors.Is(err, ErrLockTimeout) {
+			//another instance beat us to the last slot, give the job back
+			jobLogger.Info("Not creating VM, requeueing", "reason", err)
+			requeueJob(key, value, job)
+			sleep(ctx, time.Minute)
+		} else if errors.Is(err, ErrGroupAtCapacity) || errors.Is(err, ErrOrgAtCapacity) {
+			//the group filled up after we picked it, other groups may still have room
+			jobLogger.Info("Not creating VM, requeueing", "reason", err)
+			requeueJob(key, value, job)
+		} else if err != nil {
+			jobLogger.Error("Failed to create VM", "error", err)
+			retryJob(job, err, jobLogger)
 		}
 	}
 }
 
-func deleteWorker() {
-	logger := log.New(os.Stdout, "[Deleter] ", log.LstdFlags|log.Lmicroseconds)
-	for {
-		cmd := rdb.BLPop(context.Background(), 0, DeleteQueueName)
+func deleteWorker(ctx context.Context) {
+	defer workers.Done()
+
+	logger := newLogger("deleter")
+	for ctx.Err() == nil {
+		cmd := rdb.BLPop(context.Background(), queuePollTimeout, DeleteQueueName)
+		if errors.Is(cmd.Err(), redis.Nil) {
+			continue
+		}
 		if cmd.Err() != nil {
-			logger.Printf("Error: %s", cmd.Err())
+			logger.Error("Failed to read queue", "queue", DeleteQueueName, "error", cmd.Err())
+			sleep(ctx, time.Second)
+			continue
+		}
+
+		value := cmd.Val()[1]
+		job, err := decodeJob(value)
+		if errors.Is(err, ErrJobVersion) {
+			//mid upgrade, leave it for one of the newer instances
+			logger.Warn("Skipping delete job from a newer version", "error", err)
+			rdb.RPush(context.Background(), DeleteQueueName, value)
+			sleep(ctx, 10*time.Second)
 			continue
 		}
+		if err != nil {
+			logger.Error("Dropping delete job we can't read", "job", value, "error", err)
+			continue
+		}
+		logger.Info("Processing delete job", job.logAttrs()...)
+		onJobCompleted(context.Background(), job)
+	}
+}
+
+// trackRunner counts a runner as in flight until the returned func is called
+func trackRunner() func() {
+	inflight.Add(1)
+	inflightCount.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inflightCount.Add(-1)
+			inflight.Done()
+		})
+	}
+}
 
-		id := cmd.String()
-		logger.Printf("Processing delete job: %s", id)
+// sleep waits for the duration, or until the context is done
+func sleep(ctx context.Context, duration time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
 	}
 }